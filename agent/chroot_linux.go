@@ -0,0 +1,271 @@
+package agent
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// open_tree and move_mount have the same number on every architecture.
+const (
+	sysOpenTree  = 428
+	sysMoveMount = 429
+
+	openTreeClone       = 0x1
+	openTreeCloexec     = syscall.O_CLOEXEC
+	moveMountFEmptyPath = 0x4
+)
+
+// atFDCWD is AT_FDCWD, a variable so it converts to uintptr.
+var atFDCWD = -0x64
+
+// linkTarget points TargetLink at the root of pid, and returns the path to
+// use as the target root: TargetLink, or /proc/<pid>/root if it can not be
+// linked, e.g. on a read-only filesystem.
+func linkTarget(pid int) string {
+	root := fmt.Sprintf("/proc/%d/root", pid)
+	if fi, err := os.Lstat(TargetLink); err == nil {
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return root
+		}
+		os.Remove(TargetLink)
+	}
+	if err := os.Symlink(root, TargetLink); err != nil {
+		return root
+	}
+	return TargetLink
+}
+
+// workDir returns cwd inside root if it exists, root otherwise.
+func workDir(root, cwd string) string {
+	dir := filepath.Join(root, cwd)
+	if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+		return dir
+	}
+	return root
+}
+
+// cloneRoot returns a detached copy of the root mount of the debug container,
+// to be mounted in the target mount namespace. Regular bind mounts can not
+// cross mount namespaces.
+func cloneRoot() (int, error) {
+	path, err := syscall.BytePtrFromString("/")
+	if err != nil {
+		return 0, err
+	}
+	fd, _, errno := syscall.Syscall(sysOpenTree, uintptr(atFDCWD), uintptr(unsafe.Pointer(path)), openTreeClone|openTreeCloexec)
+	if errno == syscall.ENOSYS {
+		return 0, Errorf(ErrNamespace, "chroot needs Linux 5.2 or newer")
+	}
+	if errno != 0 {
+		return 0, Errorf(ErrNamespace, "unable to clone the debug image root: %v", errno)
+	}
+	return int(fd), nil
+}
+
+// toolsDirs are where the debug image can be mounted in the target
+// filesystem, which is never written to: the first existing empty directory
+// is used, so nothing of the target is hidden either.
+var toolsDirs = []string{ToolsDir, "/mnt", "/media", "/srv", "/opt", "/tmp", "/dev/shm"}
+
+// toolsMountPoint returns the first of toolsDirs that is an empty directory.
+func toolsMountPoint() (string, error) {
+	for _, dir := range toolsDirs {
+		f, err := os.Open(dir)
+		if err != nil {
+			continue
+		}
+		_, err = f.Readdirnames(1)
+		f.Close()
+		if err == io.EOF {
+			return dir, nil
+		}
+	}
+	return "", Errorf(ErrNamespace, "no empty directory in the target to mount the debug tools on, tried %s", strings.Join(toolsDirs, ", "))
+}
+
+// mountTools mounts the cloned root of the debug container on an empty
+// directory of the target, in a private copy of the current mount namespace
+// so the target never sees it, and returns the directory.
+func mountTools(tree int) (string, error) {
+	if err := syscall.Unshare(syscall.CLONE_NEWNS); err != nil {
+		return "", Errorf(ErrNamespace, "unable to unshare the mount namespace: %v", err)
+	}
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return "", Errorf(ErrNamespace, "unable to make mounts private: %v", err)
+	}
+	toolsDir, err := toolsMountPoint()
+	if err != nil {
+		return "", err
+	}
+	empty, err := syscall.BytePtrFromString("")
+	if err != nil {
+		return "", err
+	}
+	dir, err := syscall.BytePtrFromString(toolsDir)
+	if err != nil {
+		return "", err
+	}
+	_, _, errno := syscall.Syscall6(sysMoveMount, uintptr(tree), uintptr(unsafe.Pointer(empty)), uintptr(atFDCWD), uintptr(unsafe.Pointer(dir)), moveMountFEmptyPath, 0)
+	if errno != 0 {
+		return "", Errorf(ErrNamespace, "unable to mount the debug tools: %v", errno)
+	}
+	return toolsDir, nil
+}
+
+// binDirs are the usual PATH directories.
+var binDirs = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+// toolsPath is the PATH of a chroot session: the target's directories first,
+// then the debug image ones.
+func toolsPath(toolsDir string) string {
+	path := strings.Join(binDirs, ":")
+	for _, d := range binDirs {
+		path += ":" + toolsDir + d
+	}
+	return path
+}
+
+// toolsEnv describes the debug tools to the command of a chroot session.
+func toolsEnv(toolsDir string) []string {
+	env := []string{"PATH=" + toolsPath(toolsDir), "DEBUGPOD_TOOLS=" + toolsDir}
+	if sh, err := toolsResolve(toolsDir, filepath.Join(toolsDir, "bin", "sh")); err == nil {
+		if loader := toolsLoader(toolsDir, sh); loader != nil {
+			env = append(env, "DEBUGPOD_LD="+strings.Join(loader, " "))
+		}
+	}
+	return env
+}
+
+// toolsCommand returns the command running argv in a chroot session. argv[0]
+// is looked up in the PATH of the session, not in the one of the agent. The
+// debug image executables are dynamically linked against its own libraries,
+// which the target may not have, so they are run through the loader of the
+// debug image. What they start is not: DEBUGPOD_LD is the loader command to
+// run other debug tools from the session with.
+func toolsCommand(toolsDir string, argv []string) (*exec.Cmd, error) {
+	path, err := toolsLookPath(toolsDir, argv[0])
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(path, toolsDir+"/") {
+		return &exec.Cmd{Path: path, Args: argv}, nil
+	}
+	if path, err = toolsResolve(toolsDir, path); err != nil {
+		return nil, err
+	}
+	loader := toolsLoader(toolsDir, path)
+	if loader == nil {
+		return &exec.Cmd{Path: path, Args: argv}, nil
+	}
+	args := append(append(loader, path), argv[1:]...)
+	return &exec.Cmd{Path: loader[0], Args: args}, nil
+}
+
+// toolsLoader returns the loader command of path, a dynamically linked
+// executable of the debug image, using the debug image libraries. It returns
+// nil for static executables.
+func toolsLoader(toolsDir, path string) []string {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_INTERP {
+			continue
+		}
+		interp, err := ioutil.ReadAll(p.Open())
+		if err != nil {
+			return nil
+		}
+		loader, err := toolsResolve(toolsDir, filepath.Join(toolsDir, strings.TrimRight(string(interp), "\x00")))
+		if err != nil {
+			return nil
+		}
+		var libs []string
+		for _, pattern := range []string{"/lib/*-linux-gnu", "/usr/lib/*-linux-gnu", "/lib64", "/lib", "/usr/lib"} {
+			dirs, _ := filepath.Glob(toolsDir + pattern)
+			for _, dir := range dirs {
+				if dir, err = toolsResolve(toolsDir, dir); err == nil && !contains(libs, dir) {
+					libs = append(libs, dir)
+				}
+			}
+		}
+		return []string{loader, "--library-path", strings.Join(libs, ":")}
+	}
+	return nil
+}
+
+// toolsResolve resolves the symlinks of path, in the debug image mounted at
+// toolsDir, within the debug image: its absolute links would point into the
+// target filesystem otherwise.
+func toolsResolve(toolsDir, path string) (string, error) {
+	resolved := "/"
+	rest := strings.Split(strings.TrimPrefix(path, toolsDir), "/")
+	for links := 0; len(rest) > 0; {
+		name := rest[0]
+		rest = rest[1:]
+		if name == "" || name == "." {
+			continue
+		}
+		next := filepath.Join(resolved, name)
+		fi, err := os.Lstat(toolsDir + next)
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > 40 {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", path)
+		}
+		link, err := os.Readlink(toolsDir + next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(link) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(link, "/"), rest...)
+	}
+	return filepath.Join(toolsDir, resolved), nil
+}
+
+// toolsLookPath is exec.LookPath with the PATH of the chroot session.
+func toolsLookPath(toolsDir, file string) (string, error) {
+	if strings.Contains(file, "/") {
+		return file, nil
+	}
+	path := toolsPath(toolsDir)
+	for _, dir := range filepath.SplitList(path) {
+		p := filepath.Join(dir, file)
+		if strings.HasPrefix(p, toolsDir+"/") {
+			var err error
+			if p, err = toolsResolve(toolsDir, p); err != nil {
+				continue
+			}
+		}
+		if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0 {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("%s: executable file not found in %s", file, path)
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+// Package agent implements the side of debugpod that runs inside the debug
+// container: it resolves the target container's PID and runs a shell inside
+// its namespaces.
+package agent
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Error is a failure reported by the agent. The agent writes its Marker to
+// stderr, which the client recovers the error from, and exits with Code.
+type Error struct {
+	Code   int
+	Reason string
+	Detail string
+}
+
+func (e *Error) Error() string {
+	if e.Detail == "" {
+		return e.Reason
+	}
+	return fmt.Sprintf("%s: %s", e.Reason, e.Detail)
+}
+
+// Exit codes 240 and above are used for agent failures, but commands may exit
+// with them too: the client tells them apart by the marker line.
+var (
+	ErrConfig          = &Error{Code: 240, Reason: "invalid agent configuration"}
+	ErrRuntime         = &Error{Code: 241, Reason: "unable to query the container runtime"}
+	ErrPIDNotFound     = &Error{Code: 242, Reason: "target PID not found"}
+	ErrContainerExited = &Error{Code: 243, Reason: "target container exited"}
+	ErrNamespace       = &Error{Code: 244, Reason: "unable to enter target namespaces"}
+	ErrExec            = &Error{Code: 245, Reason: "unable to run command"}
+	ErrSessionGone     = &Error{Code: 246, Reason: "session shell is gone"}
+	ErrConnect         = &Error{Code: 247, Reason: "unable to connect in the target"}
+)
+
+var agentErrors = []*Error{
+	ErrConfig,
+	ErrRuntime,
+	ErrPIDNotFound,
+	ErrContainerExited,
+	ErrNamespace,
+	ErrExec,
+	ErrSessionGone,
+	ErrConnect,
+}
+
+// Errorf returns a copy of base with the given detail.
+func Errorf(base *Error, format string, args ...interface{}) *Error {
+	return &Error{Code: base.Code, Reason: base.Reason, Detail: fmt.Sprintf(format, args...)}
+}
+
+// FromExitCode returns the agent error matching an exit code, or nil if the
+// code does not belong to the agent.
+func FromExitCode(code int) *Error {
+	for _, e := range agentErrors {
+		if e.Code == code {
+			return e
+		}
+	}
+	return nil
+}
+
+// errorMarker starts the line of stderr reporting a failure of the agent, out
+// of band of the exit code of the command.
+const errorMarker = "debugpod-agent error "
+
+// Marker returns the stderr line reporting e.
+func (e *Error) Marker() string {
+	return fmt.Sprintf("%s%d: %s\n", errorMarker, e.Code, e)
+}
+
+// IsMarkerPrefix reports whether line may be the start of a marker line.
+func IsMarkerPrefix(line []byte) bool {
+	if len(line) > len(errorMarker) {
+		line = line[:len(errorMarker)]
+	}
+	return string(line) == errorMarker[:len(line)]
+}
+
+// ParseMarker returns the error reported by a marker line, nil if line is not
+// one.
+func ParseMarker(line string) *Error {
+	if !strings.HasPrefix(line, errorMarker) {
+		return nil
+	}
+	parts := strings.SplitN(strings.TrimRight(strings.TrimPrefix(line, errorMarker), "\r\n"), ": ", 2)
+	code, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil
+	}
+	base := FromExitCode(code)
+	if base == nil {
+		return nil
+	}
+	e := &Error{Code: base.Code, Reason: base.Reason}
+	if len(parts) == 2 && parts[1] != base.Reason {
+		e.Detail = strings.TrimPrefix(parts[1], base.Reason+": ")
+	}
+	return e
+}
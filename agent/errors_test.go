@@ -0,0 +1,47 @@
+package agent
+
+import "testing"
+
+func TestParseMarker(t *testing.T) {
+	tests := []struct {
+		line string
+		want *Error
+	}{
+		{Errorf(ErrConnect, "dial tcp: refused").Marker(), Errorf(ErrConnect, "dial tcp: refused")},
+		{"debugpod-agent error 247: unable to connect in the target: dial tcp: refused\r\n", Errorf(ErrConnect, "dial tcp: refused")},
+		{ErrSessionGone.Marker(), ErrSessionGone},
+		{"debugpod-agent error 246", ErrSessionGone},
+		{"debugpod-agent error 245: something else", Errorf(ErrExec, "something else")},
+		{"debugpod-agent error 1: exit", nil},
+		{"debugpod-agent error x: y", nil},
+		{"debugpod-agent error ", nil},
+		{"debugpod-agent", nil},
+		{"error 247: unable to connect in the target", nil},
+		{" debugpod-agent error 247: unable to connect in the target", nil},
+	}
+	for _, tt := range tests {
+		got := ParseMarker(tt.line)
+		if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+			t.Errorf("%q: got %#v, want %#v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestIsMarkerPrefix(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"", true},
+		{"debug", true},
+		{"debugpod-agent error ", true},
+		{"debugpod-agent error 247: x", true},
+		{"debugger", false},
+		{"hello", false},
+	}
+	for _, tt := range tests {
+		if got := IsMarkerPrefix([]byte(tt.line)); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
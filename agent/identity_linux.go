@@ -0,0 +1,166 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// secretNames matches environment variables that look like they hold secrets.
+var secretNames = regexp.MustCompile(`(?i)pass|secret|token|key|credential|auth|private|cert|dsn`)
+
+const maskedValue = "<masked>"
+
+// identity is who a process runs as.
+type identity struct {
+	uid       uint32
+	gid       uint32
+	groups    []uint32
+	effective uint64
+	bounding  uint64
+	env       []string
+}
+
+// readIdentity reads the credentials, capabilities and environment of pid.
+func readIdentity(pid int) (*identity, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	id := &identity{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "Uid:":
+			id.uid, err = parseID(fields[2])
+		case "Gid:":
+			id.gid, err = parseID(fields[2])
+		case "Groups:":
+			for _, g := range fields[1:] {
+				gid, perr := parseID(g)
+				if perr != nil {
+					err = perr
+				}
+				id.groups = append(id.groups, gid)
+			}
+		case "CapEff:":
+			id.effective, err = strconv.ParseUint(fields[1], 16, 64)
+		case "CapBnd:":
+			id.bounding, err = strconv.ParseUint(fields[1], 16, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid status of process %d: %v", pid, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	environ, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range bytes.Split(environ, []byte{0}) {
+		if len(v) > 0 {
+			id.env = append(id.env, string(v))
+		}
+	}
+	return id, nil
+}
+
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint32(id), err
+}
+
+// maskedEnv returns the environment with secret looking values masked, and
+// the names of the masked variables.
+func (id *identity) maskedEnv() ([]string, []string) {
+	var env, masked []string
+	for _, v := range id.env {
+		name := strings.SplitN(v, "=", 2)[0]
+		if secretNames.MatchString(name) {
+			masked = append(masked, name)
+			v = name + "=" + maskedValue
+		}
+		env = append(env, v)
+	}
+	sort.Strings(masked)
+	return env, masked
+}
+
+// sysProcAttr makes the command run with the credentials of id. Capabilities
+// of non-root users are passed as ambient ones.
+func (id *identity) sysProcAttr() *syscall.SysProcAttr {
+	attr := &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: id.uid, Gid: id.gid, Groups: id.groups},
+	}
+	if id.uid != 0 {
+		for c := uint(0); c < 64; c++ {
+			if id.effective&(1<<c) != 0 {
+				attr.AmbientCaps = append(attr.AmbientCaps, uintptr(c))
+			}
+		}
+	}
+	return attr
+}
+
+const linuxCapabilityVersion3 = 0x20080522
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+// limitCapabilities drops the capabilities the target can not have from the
+// bounding and inheritable sets of the calling thread, which the command
+// inherits. Root commands get the bounding set back as permitted ones.
+func (id *identity) limitCapabilities() error {
+	hdr := capHeader{version: linuxCapabilityVersion3}
+	var data [2]capData
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("unable to get capabilities: %v", errno)
+	}
+	data[0].inheritable &= uint32(id.bounding)
+	data[1].inheritable &= uint32(id.bounding >> 32)
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("unable to set capabilities: %v", errno)
+	}
+
+	lastCap := 40
+	if data, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap"); err == nil {
+		if c, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			lastCap = c
+		}
+	}
+	for c := 0; c <= lastCap; c++ {
+		if id.bounding&(1<<uint(c)) != 0 {
+			continue
+		}
+		_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_CAPBSET_DROP, uintptr(c), 0)
+		if errno != 0 {
+			return fmt.Errorf("unable to drop capability %d: %v", c, errno)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Namespaces are the Linux namespaces the agent knows how to enter.
+var Namespaces = []string{"pid", "net", "mnt", "uts", "ipc", "cgroup", "user"}
+
+// Profiles are named sets of namespaces for common debugging tasks.
+var Profiles = map[string][]string{
+	"default": {"pid", "net"},
+	"net":     {"net"},
+	"fs":      {"pid", "mnt"},
+	"full":    {"pid", "net", "mnt", "uts", "ipc", "cgroup"},
+}
+
+// NoNamespaces is the namespace list that keeps the agent in the debug
+// container, with the target only reachable through /proc.
+const NoNamespaces = "none"
+
+// ParseNamespaces parses and validates a comma separated list of namespaces.
+func ParseNamespaces(s string) ([]string, error) {
+	if s == NoNamespaces {
+		return []string{}, nil
+	}
+	var namespaces []string
+	seen := map[string]bool{}
+	for _, ns := range strings.Split(s, ",") {
+		ns = strings.TrimSpace(ns)
+		if ns == "" || seen[ns] {
+			continue
+		}
+		if !isNamespace(ns) {
+			return nil, fmt.Errorf("unknown namespace %s, valid namespaces are: %s", ns, strings.Join(Namespaces, ","))
+		}
+		seen[ns] = true
+		namespaces = append(namespaces, ns)
+	}
+	if len(namespaces) == 0 {
+		return nil, fmt.Errorf("no namespaces given")
+	}
+	return namespaces, nil
+}
+
+// ProfileNamespaces returns the namespaces of a profile.
+func ProfileNamespaces(profile string) ([]string, error) {
+	namespaces, ok := Profiles[profile]
+	if !ok {
+		var names []string
+		for name := range Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown profile %s, valid profiles are: %s", profile, strings.Join(names, ","))
+	}
+	return namespaces, nil
+}
+
+func isNamespace(ns string) bool {
+	for _, n := range Namespaces {
+		if n == ns {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,243 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+var nsenterFlags = map[string]string{
+	"user":   "--user",
+	"cgroup": "--cgroup",
+	"ipc":    "--ipc",
+	"uts":    "--uts",
+	"net":    "--net",
+	"pid":    "--pid",
+	"mnt":    "--mount",
+}
+
+var namespaceFlags = map[string]uintptr{
+	"user":   syscall.CLONE_NEWUSER,
+	"cgroup": 0x02000000, // CLONE_NEWCGROUP
+	"ipc":    syscall.CLONE_NEWIPC,
+	"uts":    syscall.CLONE_NEWUTS,
+	"net":    syscall.CLONE_NEWNET,
+	"pid":    syscall.CLONE_NEWPID,
+	"mnt":    syscall.CLONE_NEWNS,
+}
+
+// sysSetns is the setns syscall number, which package syscall lacks.
+var sysSetns = map[string]uintptr{
+	"386":     346,
+	"amd64":   308,
+	"arm":     375,
+	"arm64":   268,
+	"ppc64le": 350,
+	"s390x":   339,
+}[runtime.GOARCH]
+
+// namespaceOrder is the order namespaces are joined in, the same nsenter uses.
+var namespaceOrder = []string{"user", "cgroup", "ipc", "uts", "net", "pid", "mnt"}
+
+// Run runs argv inside the given namespaces of pid and returns its exit code.
+// The command starts in the working directory of the target.
+//
+// setns only applies to the calling thread, so the thread is locked and never
+// released, and the command is forked from it. Joining a PID namespace only
+// affects children, which is why the command cannot simply be exec'ed.
+func Run(pid int, namespaces []string, argv []string, opts RunOptions) (int, error) {
+	if len(argv) == 0 {
+		return 0, Errorf(ErrConfig, "no command to run")
+	}
+	wanted := map[string]bool{}
+	for _, ns := range namespaces {
+		if _, ok := namespaceFlags[ns]; !ok {
+			return 0, Errorf(ErrConfig, "unknown namespace %s", ns)
+		}
+		wanted[ns] = true
+	}
+	if opts.Chroot && !wanted["mnt"] {
+		return 0, Errorf(ErrConfig, "chroot needs the mnt namespace")
+	}
+	if wanted["user"] {
+		if opts.Chroot || opts.AsTarget {
+			return 0, Errorf(ErrConfig, "chroot and as-target can not be combined with the user namespace")
+		}
+		return 0, nsenter(pid, namespaces, argv)
+	}
+
+	// Both are resolved from the debug container, before leaving it.
+	cwd, _ := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+	root := "/"
+	if !wanted["mnt"] {
+		root = linkTarget(pid)
+	}
+	var id *identity
+	if opts.AsTarget {
+		var err error
+		if id, err = readIdentity(pid); err != nil {
+			return 0, Errorf(ErrContainerExited, "unable to read the identity of process %d: %v", pid, err)
+		}
+	}
+	tree := -1
+	if opts.Chroot {
+		var err error
+		if tree, err = cloneRoot(); err != nil {
+			return 0, err
+		}
+		defer syscall.Close(tree)
+	}
+
+	runtime.LockOSThread()
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var order []string
+	for _, ns := range namespaceOrder {
+		if !wanted[ns] {
+			continue
+		}
+		f, err := os.Open(fmt.Sprintf("/proc/%d/ns/%s", pid, ns))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return 0, Errorf(ErrContainerExited, "process %d is gone", pid)
+			}
+			return 0, Errorf(ErrNamespace, "%v", err)
+		}
+		files = append(files, f)
+		order = append(order, ns)
+	}
+
+	if wanted["mnt"] {
+		// A thread sharing its filesystem attributes can not change mount namespace.
+		if err := syscall.Unshare(syscall.CLONE_FS); err != nil {
+			return 0, Errorf(ErrNamespace, "unable to unshare filesystem attributes: %v", err)
+		}
+	}
+	if sysSetns == 0 {
+		return 0, Errorf(ErrNamespace, "setns is not supported on %s", runtime.GOARCH)
+	}
+	for i, f := range files {
+		_, _, errno := syscall.RawSyscall(sysSetns, f.Fd(), namespaceFlags[order[i]], 0)
+		if errno != 0 {
+			return 0, Errorf(ErrNamespace, "setns %s: %v", order[i], errno)
+		}
+	}
+	var toolsDir string
+	if opts.Chroot {
+		var err error
+		if toolsDir, err = mountTools(tree); err != nil {
+			return 0, err
+		}
+	}
+	if id != nil {
+		if err := id.limitCapabilities(); err != nil {
+			return 0, Errorf(ErrExec, "%v", err)
+		}
+	}
+
+	var cmd *exec.Cmd
+	if opts.Chroot {
+		var err error
+		if cmd, err = toolsCommand(toolsDir, argv); err != nil {
+			return 0, Errorf(ErrExec, "%v", err)
+		}
+	} else {
+		cmd = exec.Command(argv[0], argv[1:]...)
+	}
+	cmd.Env = os.Environ()
+	if id != nil {
+		cmd.Env = targetProcessEnv(id, opts.ShowSecrets)
+		cmd.SysProcAttr = id.sysProcAttr()
+	}
+	cmd.Env = append(cmd.Env, targetEnv(pid, root, cwd)...)
+	if opts.Chroot {
+		cmd.Env = append(cmd.Env, toolsEnv(toolsDir)...)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Dir = workDir(root, cwd)
+
+	// Signals are meant for the command, the agent just waits for it.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		return 0, Errorf(ErrExec, "%v", err)
+	}
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+	err := cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				return 128 + int(status.Signal()), nil
+			}
+			return status.ExitStatus(), nil
+		}
+	}
+	if err != nil {
+		return 0, Errorf(ErrExec, "%v", err)
+	}
+	return 0, nil
+}
+
+// targetProcessEnv returns the environment of the target, keeping the
+// terminal settings of the agent.
+func targetProcessEnv(id *identity, showSecrets bool) []string {
+	env := id.env
+	if !showSecrets {
+		var masked []string
+		env, masked = id.maskedEnv()
+		if len(masked) > 0 {
+			fmt.Fprintf(os.Stderr, "debugpod-agent: masked %s, use -show-secrets to see them\n", strings.Join(masked, ", "))
+		}
+	}
+	for _, name := range []string{"TERM", "COLUMNS", "LINES"} {
+		if v, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+v)
+		}
+	}
+	return env
+}
+
+// nsenter replaces the agent with nsenter(1). A multithreaded process, which a
+// Go program always is, can not join a user namespace itself.
+func nsenter(pid int, namespaces []string, argv []string) error {
+	path, err := exec.LookPath("nsenter")
+	if err != nil {
+		return Errorf(ErrNamespace, "joining a user namespace requires nsenter: %v", err)
+	}
+	args := []string{"nsenter", "--target", fmt.Sprint(pid), "--preserve-credentials"}
+	for _, ns := range namespaces {
+		args = append(args, nsenterFlags[ns])
+	}
+	args = append(args, "--")
+	args = append(args, argv...)
+	mnt := false
+	for _, ns := range namespaces {
+		mnt = mnt || ns == "mnt"
+	}
+	root := "/"
+	if !mnt {
+		root = linkTarget(pid)
+	}
+	cwd, _ := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+	if err := syscall.Exec(path, args, append(os.Environ(), targetEnv(pid, root, cwd)...)); err != nil {
+		return Errorf(ErrExec, "%v", err)
+	}
+	return nil
+}
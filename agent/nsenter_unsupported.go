@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+// Run runs argv inside the given namespaces of pid and returns its exit code.
+func Run(pid int, namespaces []string, argv []string, opts RunOptions) (int, error) {
+	return 0, Errorf(ErrNamespace, "entering namespaces is only supported on linux")
+}
+
+// Persist runs the agent in a persistent session.
+func Persist(name string, args []string, attachOnly bool) error {
+	return Errorf(ErrExec, "persistent sessions are only supported on linux")
+}
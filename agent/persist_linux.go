@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// SessionDir holds the sockets of persistent sessions.
+const SessionDir = "/run/debugpod"
+
+// Persist replaces the agent with a dtach session named name running the
+// agent again with args, or attaches to it if it already exists. With
+// attachOnly, the session must exist. Detaching is left to the client, so the
+// dtach detach and suspend keys are disabled.
+func Persist(name string, args []string, attachOnly bool) error {
+	dtach, err := exec.LookPath("dtach")
+	if err != nil {
+		return Errorf(ErrExec, "persistent sessions require dtach: %v", err)
+	}
+	if err := os.MkdirAll(SessionDir, 0700); err != nil {
+		return Errorf(ErrExec, "%v", err)
+	}
+	socket := filepath.Join(SessionDir, name+".sock")
+
+	argv := []string{"dtach"}
+	if attachOnly {
+		if _, err := os.Stat(socket); err != nil {
+			return Errorf(ErrSessionGone, "%s", name)
+		}
+		argv = append(argv, "-a", socket, "-E", "-z", "-r", "winch")
+	} else {
+		self, err := os.Executable()
+		if err != nil {
+			return Errorf(ErrExec, "%v", err)
+		}
+		argv = append(argv, "-A", socket, "-E", "-z", "-r", "winch", self)
+		argv = append(argv, args...)
+	}
+	if err := syscall.Exec(dtach, argv, os.Environ()); err != nil {
+		return Errorf(ErrExec, "%v", err)
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResolvePID returns the host PID of the init process of a container.
+func ResolvePID(runtime, endpoint, containerID string) (int, error) {
+	if containerID == "" {
+		return 0, Errorf(ErrConfig, "CONTAINER_ID env var empty")
+	}
+	var pid int
+	var err error
+	switch runtime {
+	case "docker", "":
+		pid, err = dockerPID(endpoint, containerID)
+	case "containerd", "cri-o":
+		pid, err = criPID(endpoint, containerID)
+		if err == ErrRuntime {
+			pid, err = cgroupPID(containerID)
+		}
+	case "cgroup":
+		pid, err = cgroupPID(containerID)
+	default:
+		return 0, Errorf(ErrConfig, "unsupported container runtime %s", runtime)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return pid, ValidatePID(pid, containerID)
+}
+
+// TargetLink is where the root filesystem of the target shows up in the
+// debug container when its mount namespace is not entered.
+const TargetLink = "/target"
+
+// ToolsDir is where the debug image shows up in the target filesystem with
+// chroot, if the target has it. Otherwise another empty directory is used,
+// the command finds which in DEBUGPOD_TOOLS.
+const ToolsDir = "/.debugpod"
+
+// RunOptions are how Run runs the command.
+type RunOptions struct {
+	// Chroot enters the mount namespace of the target, with the debug image
+	// mounted at DEBUGPOD_TOOLS.
+	Chroot bool
+	// AsTarget runs the command with the credentials, capabilities and
+	// environment of the target.
+	AsTarget bool
+	// ShowSecrets keeps the values of secret looking variables of the target
+	// environment, which are masked otherwise.
+	ShowSecrets bool
+}
+
+// targetEnv describes the target to the command: its PID, where its root
+// filesystem is, and its working directory within it.
+func targetEnv(pid int, root, cwd string) []string {
+	return []string{
+		fmt.Sprintf("TARGET_PID=%d", pid),
+		"TARGET_ROOT=" + root,
+		"TARGET_CWD=" + cwd,
+	}
+}
+
+// CheckPID checks that pid is alive.
+func CheckPID(pid int) error {
+	if _, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); err != nil {
+		if os.IsNotExist(err) {
+			return Errorf(ErrContainerExited, "process %d is gone", pid)
+		}
+		return Errorf(ErrPIDNotFound, "%v", err)
+	}
+	return nil
+}
+
+// ValidatePID checks that pid is alive and belongs to the container.
+func ValidatePID(pid int, containerID string) error {
+	cgroup, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if os.IsNotExist(err) {
+		return Errorf(ErrContainerExited, "process %d is gone", pid)
+	}
+	if err != nil {
+		return Errorf(ErrPIDNotFound, "unable to read cgroups of process %d: %v", pid, err)
+	}
+	if !strings.Contains(string(cgroup), containerID) {
+		return Errorf(ErrPIDNotFound, "process %d does not belong to container %s", pid, containerID)
+	}
+	return nil
+}
+
+func dockerPID(endpoint, containerID string) (int, error) {
+	if endpoint == "" {
+		endpoint = "/var/run/docker.sock"
+	}
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", endpoint)
+			},
+		},
+	}
+	resp, err := client.Get("http://docker/containers/" + containerID + "/json")
+	if err != nil {
+		return 0, Errorf(ErrRuntime, "%v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, Errorf(ErrPIDNotFound, "container %s not found", containerID)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, Errorf(ErrRuntime, "docker returned %s", resp.Status)
+	}
+	var container struct {
+		State struct {
+			Running bool
+			Pid     int
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&container); err != nil {
+		return 0, Errorf(ErrRuntime, "unable to decode container: %v", err)
+	}
+	if !container.State.Running || container.State.Pid == 0 {
+		return 0, Errorf(ErrContainerExited, "container %s is not running", containerID)
+	}
+	return container.State.Pid, nil
+}
+
+// criPID asks the CRI runtime through crictl. It returns ErrRuntime itself when
+// crictl is not usable, so the caller can fall back to cgroup scanning.
+func criPID(endpoint, containerID string) (int, error) {
+	crictl, err := exec.LookPath("crictl")
+	if err != nil {
+		return 0, ErrRuntime
+	}
+	out, err := exec.Command(crictl, "--runtime-endpoint", "unix://"+endpoint, "inspect", "--output", "json", containerID).Output()
+	if err != nil {
+		return 0, ErrRuntime
+	}
+	var container struct {
+		Status struct {
+			State string `json:"state"`
+		} `json:"status"`
+		Info struct {
+			Pid int `json:"pid"`
+		} `json:"info"`
+	}
+	if err := json.Unmarshal(out, &container); err != nil {
+		return 0, ErrRuntime
+	}
+	if container.Status.State != "" && container.Status.State != "CONTAINER_RUNNING" {
+		return 0, Errorf(ErrContainerExited, "container %s is %s", containerID, container.Status.State)
+	}
+	if container.Info.Pid == 0 {
+		return 0, ErrRuntime
+	}
+	return container.Info.Pid, nil
+}
+
+// cgroupPID scans the cgroups of every host process for the container id and
+// returns the first started of those whose parent is outside the container.
+func cgroupPID(containerID string) (int, error) {
+	files, err := filepath.Glob("/proc/[0-9]*/cgroup")
+	if err != nil {
+		return 0, Errorf(ErrPIDNotFound, "%v", err)
+	}
+	candidates := map[int]bool{}
+	for _, f := range files {
+		cgroup, err := ioutil.ReadFile(f)
+		if err != nil || !strings.Contains(string(cgroup), containerID) {
+			continue
+		}
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(f)))
+		if err == nil {
+			candidates[pid] = true
+		}
+	}
+	// Processes added with exec have their parent outside the container too,
+	// the init process is the one started first.
+	found, foundStart := 0, uint64(0)
+	for pid := range candidates {
+		if ppid, err := parentPID(pid); err != nil || candidates[ppid] {
+			continue
+		}
+		start, err := startTime(pid)
+		if err != nil {
+			continue
+		}
+		if found == 0 || start < foundStart || (start == foundStart && pid < found) {
+			found, foundStart = pid, start
+		}
+	}
+	if found == 0 {
+		return 0, Errorf(ErrPIDNotFound, "no process found in the cgroups of container %s", containerID)
+	}
+	return found, nil
+}
+
+// startTime returns when pid started, in clock ticks since boot.
+func startTime(pid int) (uint64, error) {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name may contain spaces, the fields after it do not.
+	i := strings.LastIndexByte(string(stat), ')')
+	if i < 0 {
+		return 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(stat[i+1:]))
+	// starttime is the 22nd field, the 20th after the command name.
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+func parentPID(pid int) (int, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if strings.HasPrefix(s.Text(), "PPid:") {
+			return strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(s.Text(), "PPid:")))
+		}
+	}
+	return 0, fmt.Errorf("no PPid in /proc/%d/status", pid)
+}
@@ -0,0 +1,29 @@
+package agent
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+const relayDialTimeout = 10 * time.Second
+
+// Relay connects to address and copies in to the connection and the
+// connection to out, until the other end closes it.
+func Relay(address string, in io.Reader, out io.Writer) error {
+	conn, err := net.DialTimeout("tcp", address, relayDialTimeout)
+	if err != nil {
+		return Errorf(ErrConnect, "%v", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		io.Copy(conn, in)
+		// Let the other end know there is nothing else to read.
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}()
+	_, err = io.Copy(out, conn)
+	return err
+}
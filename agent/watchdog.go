@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// HeartbeatAnnotation holds the last time the client was seen alive.
+	HeartbeatAnnotation = "debugpod.josledp.github.io/heartbeat"
+	// ExpiresAnnotation holds when the session expires.
+	ExpiresAnnotation = "debugpod.josledp.github.io/expires"
+	// DetachedAnnotation is set while no client is attached to the session on
+	// purpose, heartbeats are not expected then.
+	DetachedAnnotation = "debugpod.josledp.github.io/detached"
+	// AnnotationsFile is where the downward API exposes the pod annotations.
+	AnnotationsFile = "/etc/debugpod/annotations"
+	// HeartbeatFile is where ephemeral containers, which can not mount the
+	// downward API, get their heartbeat from, in the annotations file format.
+	HeartbeatFile = "/tmp/debugpod.heartbeat"
+)
+
+// Watchdog returns once the heartbeat found in the annotations file has not
+// been renewed for grace, meaning the client is gone, or the session expires.
+func Watchdog(annotationsFile string, grace time.Duration) error {
+	lastSeen := time.Now()
+	for {
+		annotations, err := ReadAnnotations(annotationsFile)
+		if err == nil {
+			heartbeat, err := time.Parse(time.RFC3339, annotations[HeartbeatAnnotation])
+			if err == nil && heartbeat.After(lastSeen) {
+				lastSeen = heartbeat
+			}
+			if annotations[DetachedAnnotation] == "true" {
+				lastSeen = time.Now()
+			}
+			expires, err := time.Parse(time.RFC3339, annotations[ExpiresAnnotation])
+			if err == nil && time.Now().After(expires) {
+				return fmt.Errorf("session expired at %s", expires.Format(time.RFC3339))
+			}
+		}
+		if time.Since(lastSeen) > grace {
+			return fmt.Errorf("no heartbeat since %s", lastSeen.Format(time.RFC3339))
+		}
+		time.Sleep(grace / 10)
+	}
+}
+
+// WriteHeartbeat renews the heartbeat in file, for Watchdog to read.
+func WriteHeartbeat(file string) error {
+	data := fmt.Sprintf("%s=%s\n", HeartbeatAnnotation, strconv.Quote(time.Now().UTC().Format(time.RFC3339)))
+	// Renamed into place, so Watchdog never reads it half written.
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(data), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// ReadAnnotations parses a downward API annotations file, made of key="value"
+// lines.
+func ReadAnnotations(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	annotations := map[string]string{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value, err := strconv.Unquote(parts[1])
+		if err != nil {
+			continue
+		}
+		annotations[parts[0]] = value
+	}
+	return annotations, s.Err()
+}
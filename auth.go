@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+
+	clientauthv1alpha1 "k8s.io/client-go/pkg/apis/clientauthentication/v1alpha1"
+	clientauthv1beta1 "k8s.io/client-go/pkg/apis/clientauthentication/v1beta1"
+	_ "k8s.io/client-go/plugin/pkg/client/auth/azure"
+	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
+	_ "k8s.io/client-go/plugin/pkg/client/auth/openstack"
+
+	"k8s.io/client-go/rest"
+)
+
+// authProviders are the auth providers compiled in. Exec credential plugins,
+// such as aws-iam-authenticator, are run by client-go itself.
+var authProviders = map[string]bool{
+	"azure":     true,
+	"gcp":       true,
+	"oidc":      true,
+	"openstack": true,
+}
+
+// execAPIVersions are the exec credential plugin versions client-go speaks.
+var execAPIVersions = map[string]bool{
+	clientauthv1alpha1.SchemeGroupVersion.String(): true,
+	clientauthv1beta1.SchemeGroupVersion.String():  true,
+}
+
+// checkAuth fails with an actionable error if config authenticates in a way
+// this binary does not support.
+func checkAuth(config *rest.Config) error {
+	if p := config.AuthProvider; p != nil && !authProviders[p.Name] {
+		return fmt.Errorf("the kubeconfig user authenticates with the %s auth provider, which is not included in %s: "+
+			"configure an exec credential plugin for it instead", p.Name, commandName)
+	}
+	if e := config.ExecProvider; e != nil && !execAPIVersions[e.APIVersion] {
+		return fmt.Errorf("the exec credential plugin %s uses apiVersion %s, only %s and %s are supported: "+
+			"set one of them in the exec section of the kubeconfig user", e.Command, e.APIVersion, clientauthv1alpha1.SchemeGroupVersion, clientauthv1beta1.SchemeGroupVersion)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	dockerterm "github.com/docker/docker/pkg/term"
+)
+
+// captureStopTimeout is how long an interrupted capture has to stop before
+// the debug pod is cleaned anyway.
+const captureStopTimeout = 10 * time.Second
+
+// captureScript runs the capture in the background and interrupts it when
+// stdin is closed, so tcpdump stops cleanly and flushes what it captured.
+// Background commands get /dev/null as stdin unless redirected explicitly, and
+// ignore SIGINT, so SIGTERM stops it: tcpdump handles both the same.
+const captureScript = `exec 3<&0
+"$@" 3<&- &
+pid=$!
+{ cat >/dev/null; kill $pid; } <&3 >/dev/null 2>&1 &
+wait $pid`
+
+func captureCommand(args []string) {
+	fg := flag.NewFlagSet(commandName+" capture", flag.ExitOnError)
+	fg.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s capture [options]\n", commandName)
+		fmt.Fprintf(os.Stderr, "e.g. %s capture -pod db-0 -f 'port 5432' -w db.pcap\n", commandName)
+		fmt.Fprintf(os.Stderr, "     %s capture -pod db-0 | wireshark -k -i -\n", commandName)
+		fg.PrintDefaults()
+	}
+	cf := addClientFlags(fg)
+	tf := addTargetFlags(fg)
+	df := addDebugFlags(fg)
+	filter := fg.String("f", "", "(optional) tcpdump filter expression, e.g. 'port 5432'")
+	output := fg.String("w", "-", "(optional) file to write the pcap data to, - for stdout")
+	iface := fg.String("i", "any", "(optional) interface to capture on")
+	duration := fg.Duration("duration", 0, "(optional) stop the capture after this long, 0 to capture until interrupted")
+	count := fg.Int("count", 0, "(optional) stop the capture after this many packets, 0 for no limit")
+
+	err := fg.Parse(args)
+	if err != nil {
+		log.Fatalf("unable to parse args: %v", err)
+	}
+	if fg.NArg() != 0 || *duration < 0 || *count < 0 {
+		fg.Usage()
+		os.Exit(1)
+	}
+	tf.check(fg)
+
+	out := io.Writer(os.Stdout)
+	if *output == "-" {
+		if dockerterm.IsTerminal(os.Stdout.Fd()) {
+			log.Fatalf("refusing to write pcap data to a terminal, use -w or pipe it")
+		}
+	} else {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("unable to create capture file: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	opts := df.options(fg)
+	opts.Node = *tf.node
+	opts.Selector = *tf.selector
+	// Only the network of the target is needed, tcpdump comes from the image.
+	opts.Namespaces = []string{"net"}
+	config := cf.config()
+
+	debugPod, cancel, end := createDebugPod(config, cf.namespace(), *tf.pod, opts)
+
+	stop, stopCapture := io.Pipe()
+	superviseCapture(debugPod, stopCapture, cancel, end)
+
+	command := []string{"sh", "-c", captureScript, "capture"}
+	if *duration > 0 {
+		command = append(command, "timeout", "--preserve-status", strconv.FormatFloat(duration.Seconds(), 'f', -1, 64))
+	}
+	command = append(command, "tcpdump", "-U", "-n", "-i", *iface, "-w", "-")
+	if *count > 0 {
+		command = append(command, "-c", strconv.Itoa(*count))
+	}
+	if *filter != "" {
+		command = append(command, *filter)
+	}
+
+	log.Printf("capturing on %s, interrupt to stop", debugPod.targetDescription())
+	code, err := debugPod.ExecUnrecorded(command, stop, out, os.Stderr)
+	if err != nil {
+		log.Printf("%v", err)
+		exit(cancel, end, 1)
+	}
+	if code == 0 && *output != "-" {
+		log.Printf("capture written to %s", *output)
+	}
+	exit(cancel, end, code)
+}
+
+// superviseCapture stops the capture when the process is interrupted, and
+// exits, cleaning the debug pod, if it is interrupted again or the session
+// expires.
+func superviseCapture(debugPod *DebugPod, stopCapture io.Closer, cancel context.CancelFunc, end <-chan struct{}) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	expired := debugPod.Expired(os.Stderr)
+	go func() {
+		select {
+		case <-c:
+			log.Println("stopping capture, interrupt again to abort")
+			stopCapture.Close()
+		case <-expired:
+			exit(cancel, end, 1)
+		}
+		select {
+		case <-c:
+		case <-expired:
+		case <-time.After(captureStopTimeout):
+			log.Println("capture did not stop in time")
+		}
+		exit(cancel, end, 1)
+	}()
+}
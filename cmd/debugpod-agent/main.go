@@ -0,0 +1,159 @@
+// debugpod-agent runs inside the debug container. It finds the target
+// container's PID and starts a shell in its namespaces. When it fails it
+// writes the marker of an agent.Error to stderr, so the client can tell what
+// went wrong apart from the exit code of the command.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/josledp/debugger/agent"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "watchdog" {
+		watchdog(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "heartbeat" {
+		heartbeat(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "connect" {
+		connect(os.Args[2:])
+		return
+	}
+
+	fg := flag.NewFlagSet("debugpod-agent", flag.ExitOnError)
+	nsList := fg.String("namespaces", "pid,net", "comma separated list of namespaces to enter")
+	targetPID := fg.Int("pid", 0, "PID of the target, instead of resolving it through the container runtime")
+	persist := fg.String("persist", "", "run inside the named persistent session, creating it if needed")
+	chroot := fg.Bool("chroot", false, "run in the target filesystem, with the debug image mounted at $DEBUGPOD_TOOLS")
+	asTarget := fg.Bool("as-target", false, "run as the user of the target, with its capabilities and environment")
+	showSecrets := fg.Bool("show-secrets", false, "do not mask secret looking variables of the target environment")
+	reattach := fg.String("reattach", "", "attach to an existing persistent session")
+	fg.Parse(os.Args[1:])
+
+	if *reattach != "" {
+		fail(agent.Persist(*reattach, nil, true))
+	}
+
+	namespaces, err := agent.ParseNamespaces(*nsList)
+	if err != nil {
+		fail(agent.Errorf(agent.ErrConfig, "%v", err))
+	}
+
+	pid := *targetPID
+	if pid == 0 {
+		pid, err = agent.ResolvePID(os.Getenv("CONTAINER_RUNTIME"), os.Getenv("RUNTIME_ENDPOINT"), os.Getenv("CONTAINER_ID"))
+	} else {
+		err = agent.CheckPID(pid)
+	}
+	if err != nil {
+		fail(err)
+	}
+
+	command := fg.Args()
+	if len(command) == 0 {
+		command = []string{"/bin/bash", "-i"}
+		if *chroot {
+			// The bash of the target if it has one, the debug image one otherwise.
+			command = []string{"bash", "-i"}
+		}
+	}
+	if *persist != "" {
+		// The target is resolved here so failures are reported to the client
+		// instead of inside the session.
+		ns := strings.Join(namespaces, ",")
+		if ns == "" {
+			ns = agent.NoNamespaces
+		}
+		args := []string{"-pid", strconv.Itoa(pid), "-namespaces", ns}
+		for flag, set := range map[string]bool{"-chroot": *chroot, "-as-target": *asTarget, "-show-secrets": *showSecrets} {
+			if set {
+				args = append(args, flag)
+			}
+		}
+		args = append(append(args, "--"), command...)
+		fail(agent.Persist(*persist, args, false))
+	}
+	code, err := agent.Run(pid, namespaces, command, agent.RunOptions{Chroot: *chroot, AsTarget: *asTarget, ShowSecrets: *showSecrets})
+	if err != nil {
+		fail(err)
+	}
+	os.Exit(code)
+}
+
+// watchdog is the main process of debug pods, it exits when the client stops
+// sending heartbeats so forgotten debug pods terminate.
+func watchdog(args []string) {
+	fg := flag.NewFlagSet("debugpod-agent watchdog", flag.ExitOnError)
+	annotations := fg.String("annotations", agent.AnnotationsFile, "downward API file with the pod annotations")
+	grace := fg.Duration("grace", 5*time.Minute, "how long to wait for a heartbeat before exiting")
+	lifetime := fg.Duration("lifetime", 0, "exit after this long even with heartbeats, 0 to only follow the expires annotation")
+	fg.Parse(args)
+
+	var expired <-chan time.Time
+	if *lifetime > 0 {
+		expired = time.After(*lifetime)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan error, 1)
+	go func() {
+		done <- agent.Watchdog(*annotations, *grace)
+	}()
+
+	select {
+	case <-signals:
+	case <-expired:
+		fmt.Fprintf(os.Stderr, "debugpod-agent: session lasted %v, exiting\n", *lifetime)
+	case err := <-done:
+		fmt.Fprintf(os.Stderr, "debugpod-agent: %v, exiting\n", err)
+	}
+}
+
+// heartbeat renews the heartbeat of a watchdog reading a heartbeat file, the
+// client runs it over exec where it can not annotate the pod.
+func heartbeat(args []string) {
+	fg := flag.NewFlagSet("debugpod-agent heartbeat", flag.ExitOnError)
+	file := fg.String("file", agent.HeartbeatFile, "heartbeat file read by the watchdog")
+	fg.Parse(args)
+
+	if err := agent.WriteHeartbeat(*file); err != nil {
+		fail(agent.Errorf(agent.ErrExec, "unable to write the heartbeat: %v", err))
+	}
+}
+
+// connect relays stdin and stdout to a TCP address, it is run in the network
+// namespace of the target to forward ports into it.
+func connect(args []string) {
+	fg := flag.NewFlagSet("debugpod-agent connect", flag.ExitOnError)
+	fg.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: debugpod-agent connect <host:port>")
+	}
+	fg.Parse(args)
+	if fg.NArg() != 1 {
+		fail(agent.Errorf(agent.ErrConfig, "connect needs exactly one address"))
+	}
+	if err := agent.Relay(fg.Arg(0), os.Stdin, os.Stdout); err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	e, ok := err.(*agent.Error)
+	if !ok {
+		e = agent.Errorf(agent.ErrExec, "%v", err)
+	}
+	fmt.Fprint(os.Stderr, e.Marker())
+	os.Exit(e.Code)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/api/core/v1"
+)
+
+const defaultContainerAnnotation = "kubectl.kubernetes.io/default-container"
+
+// targetPod is the pod being debugged. The vendored core/v1 types predate
+// ephemeral containers, so those are decoded separately from the raw object.
+type targetPod struct {
+	*v1.Pod
+	// raw is the pod as served, with the fields v1.Pod does not know about.
+	raw                        []byte
+	ephemeralContainers        []v1.Container
+	ephemeralContainerStatuses []v1.ContainerStatus
+}
+
+func decodeTargetPod(raw []byte) (*targetPod, error) {
+	pod := &v1.Pod{}
+	if err := json.Unmarshal(raw, pod); err != nil {
+		return nil, fmt.Errorf("unable to decode pod: %v", err)
+	}
+	var ephemeral struct {
+		Spec struct {
+			EphemeralContainers []v1.Container `json:"ephemeralContainers"`
+		} `json:"spec"`
+		Status struct {
+			EphemeralContainerStatuses []v1.ContainerStatus `json:"ephemeralContainerStatuses"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(raw, &ephemeral); err != nil {
+		return nil, fmt.Errorf("unable to decode pod: %v", err)
+	}
+	return &targetPod{
+		Pod:                        pod,
+		raw:                        raw,
+		ephemeralContainers:        ephemeral.Spec.EphemeralContainers,
+		ephemeralContainerStatuses: ephemeral.Status.EphemeralContainerStatuses,
+	}, nil
+}
+
+// containerName resolves the name of a container from the spec, looking at
+// regular, init and ephemeral containers. An empty name selects the container
+// from the default-container annotation, or the first container of the pod.
+func (tp *targetPod) containerName(name string) (string, error) {
+	if name == "" {
+		name = tp.Annotations[defaultContainerAnnotation]
+	}
+	if name == "" {
+		if len(tp.Spec.Containers) == 0 {
+			return "", fmt.Errorf("pod %s has no containers", tp.Name)
+		}
+		name = tp.Spec.Containers[0].Name
+	}
+
+	if !tp.hasContainer(name) {
+		return "", fmt.Errorf("container %s not found in pod %s, available containers: %s", name, tp.Name, strings.Join(tp.containerNames(), ", "))
+	}
+	return name, nil
+}
+
+// containerStatus resolves the status of the named container, as
+// containerName does. The container must have been started.
+func (tp *targetPod) containerStatus(name string) (*v1.ContainerStatus, error) {
+	name, err := tp.containerName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := [][]v1.ContainerStatus{
+		tp.Status.ContainerStatuses,
+		tp.Status.InitContainerStatuses,
+		tp.ephemeralContainerStatuses,
+	}
+	for _, s := range statuses {
+		for i := range s {
+			if s[i].Name == name {
+				if s[i].ContainerID == "" {
+					return nil, fmt.Errorf("container %s in pod %s has not been started yet", name, tp.Name)
+				}
+				return &s[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("container %s in pod %s has no status yet", name, tp.Name)
+}
+
+func (tp *targetPod) hasContainer(name string) bool {
+	for _, c := range tp.allContainers() {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (tp *targetPod) allContainers() []v1.Container {
+	var containers []v1.Container
+	containers = append(containers, tp.Spec.Containers...)
+	containers = append(containers, tp.Spec.InitContainers...)
+	containers = append(containers, tp.ephemeralContainers...)
+	return containers
+}
+
+func (tp *targetPod) containerNames() []string {
+	var names []string
+	for _, c := range tp.Spec.Containers {
+		names = append(names, c.Name)
+	}
+	for _, c := range tp.Spec.InitContainers {
+		names = append(names, c.Name+" (init)")
+	}
+	for _, c := range tp.ephemeralContainers {
+		names = append(names, c.Name+" (ephemeral)")
+	}
+	return names
+}
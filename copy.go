@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"github.com/josledp/debugger/agent"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// copyAgentDir is where the agent is copied into the cloned pod, so the
+	// target image does not need to have anything.
+	copyAgentDir        = "/debugpod"
+	copyAgentVolumeName = "debugpod-agent"
+)
+
+// copyShell prefers bash in the target image, but falls back to sh.
+var copyShell = []string{"/bin/sh", "-c", "if command -v bash >/dev/null 2>&1; then exec bash -i; else exec sh -i; fi"}
+
+// setupCopy prepares a copy of the target pod, with the target container
+// running the agent's watchdog instead of its command. Containers that crash
+// or already exited can be debugged that way.
+func (dp *DebugPod) setupCopy(pod *targetPod, container, image string) error {
+	dp.mode = modePod
+	dp.copy = true
+	dp.container = container
+	dp.agentPath = path.Join(copyAgentDir, path.Base(agentBinary))
+	// The agent runs as another process of the target container.
+	dp.agentArgs = []string{"-pid", "1"}
+	dp.namespaces = []string{}
+
+	// The copy is built from the pod as served, so the fields the vendored
+	// API does not know about are kept.
+	var copied map[string]interface{}
+	if err := json.Unmarshal(pod.raw, &copied); err != nil {
+		return fmt.Errorf("unable to decode pod: %v", err)
+	}
+	spec, _ := copied["spec"].(map[string]interface{})
+	if spec == nil {
+		return fmt.Errorf("pod %s has no spec", pod.Name)
+	}
+	// Ephemeral containers can only be added to existing pods.
+	delete(spec, "ephemeralContainers")
+	stripProbes(spec["initContainers"])
+	stripProbes(spec["containers"])
+
+	found := false
+	containers, _ := spec["containers"].([]interface{})
+	for _, c := range containers {
+		c, ok := c.(map[string]interface{})
+		if !ok || c["name"] != container {
+			continue
+		}
+		found = true
+		if image != "" {
+			c["image"] = image
+			c["imagePullPolicy"] = dp.pullPolicy
+		}
+		c["command"] = []string{dp.agentPath, "watchdog", "-grace", heartbeatGrace.String()}
+		delete(c, "args")
+		c["volumeMounts"] = appendJSON(c["volumeMounts"],
+			v1.VolumeMount{Name: copyAgentVolumeName, MountPath: copyAgentDir},
+			v1.VolumeMount{Name: annotationsVolumeName, MountPath: path.Dir(agent.AnnotationsFile)},
+		)
+	}
+	if !found {
+		return fmt.Errorf("only regular containers can be copied, %s is not one", container)
+	}
+
+	spec["initContainers"] = appendJSON(spec["initContainers"], v1.Container{
+		Name:            copyAgentVolumeName,
+		Image:           dp.image,
+		ImagePullPolicy: dp.pullPolicy,
+		Command:         []string{"cp", agentBinary, dp.agentPath},
+		VolumeMounts:    []v1.VolumeMount{v1.VolumeMount{Name: copyAgentVolumeName, MountPath: copyAgentDir}},
+		Resources:       debugResources,
+	})
+	spec["volumes"] = appendJSON(spec["volumes"],
+		v1.Volume{Name: copyAgentVolumeName, VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}},
+		v1.Volume{Name: annotationsVolumeName, VolumeSource: v1.VolumeSource{DownwardAPI: &v1.DownwardAPIVolumeSource{
+			Items: []v1.DownwardAPIVolumeFile{
+				v1.DownwardAPIVolumeFile{Path: path.Base(agent.AnnotationsFile), FieldRef: &v1.ObjectFieldSelector{FieldPath: "metadata.annotations"}},
+			},
+		}}},
+	)
+	for _, s := range dp.pullSecrets {
+		spec["imagePullSecrets"] = appendJSON(spec["imagePullSecrets"], v1.LocalObjectReference{Name: s})
+	}
+	for _, t := range dp.tolerations {
+		spec["tolerations"] = appendJSON(spec["tolerations"], t)
+	}
+	spec["restartPolicy"] = v1.RestartPolicyNever
+	spec["activeDeadlineSeconds"] = int64(maxSessionLifetime.Seconds())
+
+	// Only the metadata of the session is set: without the labels of the
+	// target the copy does not get traffic from its services, and without
+	// its owner references it is not managed by its controller.
+	labels, annotations := dp.sessionMeta()
+	copied["metadata"] = metav1.ObjectMeta{
+		Name:        dp.podName,
+		Namespace:   dp.targetNamespace,
+		Labels:      labels,
+		Annotations: annotations,
+	}
+	delete(copied, "status")
+	dp.copyPod = copied
+	return nil
+}
+
+// stripProbes removes the probes of a list of containers, the watchdog does
+// not answer them.
+func stripProbes(containers interface{}) {
+	list, _ := containers.([]interface{})
+	for _, c := range list {
+		if c, ok := c.(map[string]interface{}); ok {
+			delete(c, "livenessProbe")
+			delete(c, "readinessProbe")
+			delete(c, "startupProbe")
+		}
+	}
+}
+
+// appendJSON appends items to a list of a decoded JSON object.
+func appendJSON(list interface{}, items ...interface{}) []interface{} {
+	l, _ := list.([]interface{})
+	return append(l, items...)
+}
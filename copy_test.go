@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+const copyTargetPod = `{
+	"metadata": {
+		"name": "migrate-x7k2p",
+		"labels": {"job-name": "migrate"},
+		"ownerReferences": [{"kind": "Job", "name": "migrate"}],
+		"resourceVersion": "42"
+	},
+	"spec": {
+		"nodeName": "node-1",
+		"containers": [
+			{"name": "migrate", "image": "migrate:1", "args": ["up"], "startupProbe": {}, "livenessProbe": {}, "resizePolicy": [{"resourceName": "cpu"}]},
+			{"name": "proxy", "image": "proxy:1", "readinessProbe": {}}
+		],
+		"initContainers": [{"name": "sidecar", "restartPolicy": "Always", "startupProbe": {}}],
+		"ephemeralContainers": [{"name": "debugger"}],
+		"restartPolicy": "OnFailure"
+	},
+	"status": {"phase": "Failed"}
+}`
+
+func TestSetupCopy(t *testing.T) {
+	pod, err := decodeTargetPod([]byte(copyTargetPod))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp := &DebugPod{podName: "debug-migrate", session: "s1", lifetime: newLifetime(time.Hour, 0)}
+	if err := dp.setupCopy(pod, "migrate", ""); err != nil {
+		t.Fatal(err)
+	}
+	body, err := dp.podBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var copied struct {
+		Metadata struct {
+			Name            string            `json:"name"`
+			Labels          map[string]string `json:"labels"`
+			OwnerReferences []interface{}     `json:"ownerReferences"`
+			ResourceVersion string            `json:"resourceVersion"`
+		} `json:"metadata"`
+		Spec struct {
+			NodeName            string                   `json:"nodeName"`
+			RestartPolicy       string                   `json:"restartPolicy"`
+			Containers          []map[string]interface{} `json:"containers"`
+			InitContainers      []map[string]interface{} `json:"initContainers"`
+			EphemeralContainers []interface{}            `json:"ephemeralContainers"`
+		} `json:"spec"`
+		Status interface{} `json:"status"`
+	}
+	if err := json.Unmarshal(body, &copied); err != nil {
+		t.Fatal(err)
+	}
+
+	if copied.Metadata.Name != "debug-migrate" || copied.Metadata.Labels["job-name"] != "" {
+		t.Errorf("metadata: got %s with labels %v", copied.Metadata.Name, copied.Metadata.Labels)
+	}
+	if copied.Metadata.OwnerReferences != nil || copied.Metadata.ResourceVersion != "" || copied.Status != nil {
+		t.Errorf("the owner references, resource version and status of the target were copied")
+	}
+	if copied.Spec.NodeName != "node-1" || copied.Spec.RestartPolicy != "Never" || copied.Spec.EphemeralContainers != nil {
+		t.Errorf("spec: got node %s, restart policy %s and ephemeral containers %v", copied.Spec.NodeName, copied.Spec.RestartPolicy, copied.Spec.EphemeralContainers)
+	}
+	for _, c := range append(copied.Spec.Containers, copied.Spec.InitContainers...) {
+		for _, probe := range []string{"livenessProbe", "readinessProbe", "startupProbe"} {
+			if _, ok := c[probe]; ok {
+				t.Errorf("container %s: %s was kept", c["name"], probe)
+			}
+		}
+	}
+	target := copied.Spec.Containers[0]
+	if _, ok := target["resizePolicy"]; !ok {
+		t.Errorf("the fields unknown to v1.Pod were dropped")
+	}
+	if _, ok := target["args"]; ok {
+		t.Errorf("the args of the target container were kept")
+	}
+	if len(copied.Spec.InitContainers) != 2 || copied.Spec.InitContainers[1]["name"] != copyAgentVolumeName {
+		t.Errorf("init containers: got %v", copied.Spec.InitContainers)
+	}
+}
+
+func TestSetupCopyNotRegular(t *testing.T) {
+	pod, err := decodeTargetPod([]byte(copyTargetPod))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp := &DebugPod{lifetime: newLifetime(time.Hour, 0)}
+	if err := dp.setupCopy(pod, "sidecar", ""); err == nil {
+		t.Errorf("got a copy of an init container, want an error")
+	}
+}
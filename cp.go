@@ -0,0 +1,308 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+func cpCommand(args []string) {
+	fg := flag.NewFlagSet(commandName+" cp", flag.ExitOnError)
+	fg.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s cp [options] <pod>:<path> <local path>\n", commandName)
+		fmt.Fprintf(os.Stderr, "       %s cp [options] <local path> <pod>:<path>\n", commandName)
+		fmt.Fprintln(os.Stderr, "<pod> may also be a workload such as deploy/api")
+		fg.PrintDefaults()
+	}
+	cf := addClientFlags(fg)
+	df := addDebugFlags(fg)
+
+	err := fg.Parse(args)
+	if err != nil {
+		log.Fatalf("unable to parse args: %v", err)
+	}
+	if fg.NArg() != 2 {
+		fg.Usage()
+		os.Exit(1)
+	}
+
+	src, dst := fg.Arg(0), fg.Arg(1)
+	srcTarget, srcPath, srcRemote := splitRemotePath(src)
+	dstTarget, dstPath, dstRemote := splitRemotePath(dst)
+	if srcRemote == dstRemote {
+		log.Println("exactly one of source and destination must be a <pod>:<path>")
+		fg.Usage()
+		os.Exit(1)
+	}
+	target, remotePath := srcTarget, srcPath
+	if dstRemote {
+		target, remotePath = dstTarget, dstPath
+	}
+	if !path.IsAbs(remotePath) {
+		log.Fatalf("remote path %s must be absolute", remotePath)
+	}
+
+	opts := df.options(fg)
+	// Files are reached through the target's root, not by entering namespaces.
+	opts.Namespaces = []string{}
+	config := cf.config()
+
+	debugPod, cancel, end := startDebugPod(config, cf.namespace(), target, opts)
+
+	if srcRemote {
+		err = debugPod.CopyFrom(remotePath, dst)
+	} else {
+		err = debugPod.CopyTo(src, remotePath)
+	}
+	if err != nil {
+		log.Printf("%v", err)
+		exit(cancel, end, 1)
+	}
+	exit(cancel, end, 0)
+}
+
+// splitRemotePath splits <pod>:<path> arguments. Local paths starting with .
+// or / are never remote.
+func splitRemotePath(arg string) (string, string, bool) {
+	if strings.HasPrefix(arg, ".") || strings.HasPrefix(arg, "/") {
+		return "", arg, false
+	}
+	parts := strings.SplitN(arg, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", arg, false
+	}
+	return parts[0], parts[1], true
+}
+
+// CopyFrom copies a file or directory of the target's filesystem to local.
+func (dp *DebugPod) CopyFrom(remote, local string) error {
+	remote = path.Clean(remote)
+	base := path.Base(remote)
+
+	pr, pw := io.Pipe()
+	go func() {
+		var stderr bytes.Buffer
+		code, err := dp.Exec([]string{"sh", "-c", `cd "$TARGET_ROOT$(dirname "$0")" && tar cf - "$(basename "$0")"`, remote}, nil, pw, &stderr)
+		if err == nil && code != 0 {
+			err = fmt.Errorf("unable to read %s: %s", remote, strings.TrimSpace(stderr.String()))
+		}
+		pw.CloseWithError(err)
+	}()
+
+	if info, err := os.Stat(local); err == nil && info.IsDir() {
+		local = filepath.Join(local, base)
+	}
+	err := untar(pr, base, local)
+	pr.Close()
+	return err
+}
+
+// CopyTo copies a local file or directory into the target's filesystem.
+func (dp *DebugPod) CopyTo(local, remote string) error {
+	remote = path.Clean(remote)
+	code, err := dp.Exec([]string{"sh", "-c", `test -d "$TARGET_ROOT$0"`, remote}, nil, ioutil.Discard, ioutil.Discard)
+	if err != nil {
+		return err
+	}
+	dir, name := path.Dir(remote), path.Base(remote)
+	if code == 0 {
+		dir, name = remote, filepath.Base(local)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(tarPath(pw, local, name))
+	}()
+
+	var stderr bytes.Buffer
+	code, err = dp.Exec([]string{"sh", "-c", `mkdir -p "$TARGET_ROOT$0" && tar xf - --no-same-owner -C "$TARGET_ROOT$0"`, dir}, pr, ioutil.Discard, &stderr)
+	pr.Close()
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("unable to write %s: %s", remote, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// tarPath writes src, a file or a directory, to w as an archive rooted at name.
+func tarPath(w io.Writer, src, name string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(file)
+			if err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(name, filepath.ToSlash(rel))
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// untar extracts an archive rooted at base into dest, preserving modes.
+// Directory modes are applied last, in case they are not writable. The archive
+// comes from the target, so it is not trusted: symlinks must stay inside the
+// extracted tree and are never written through.
+func untar(r io.Reader, base, dest string) error {
+	tr := tar.NewReader(r)
+	dirModes := map[string]os.FileMode{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			for dir, mode := range dirModes {
+				if err := os.Chmod(dir, mode); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean(hdr.Name)
+		var file string
+		switch {
+		case name == base:
+			file = dest
+		case strings.HasPrefix(name, base+"/"):
+			file = filepath.Join(dest, filepath.FromSlash(strings.TrimPrefix(name, base+"/")))
+		default:
+			return fmt.Errorf("unexpected file %s in archive", hdr.Name)
+		}
+
+		if err := checkParents(dest, file); err != nil {
+			return err
+		}
+		// Entries replace whatever an earlier one left at their path, instead
+		// of following it if it is a symlink.
+		if fi, err := os.Lstat(file); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+		}
+
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(file, 0700); err != nil {
+				return err
+			}
+			dirModes[file] = mode
+			continue
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if !localLink(hdr.Linkname) {
+				return fmt.Errorf("refusing to extract %s, its link %s points outside of %s", hdr.Name, hdr.Linkname, base)
+			}
+			os.Remove(file)
+			if err := os.Symlink(hdr.Linkname, file); err != nil {
+				return err
+			}
+			delete(dirModes, file)
+			continue
+		default:
+			log.Printf("skipping %s, unsupported file type", hdr.Name)
+			continue
+		}
+		if err := os.Chmod(file, mode); err != nil {
+			return err
+		}
+		os.Chtimes(file, hdr.ModTime, hdr.ModTime)
+	}
+}
+
+// checkParents fails if any directory between dest and file is a symlink, so
+// nothing is written outside of dest through a symlink of the archive.
+func checkParents(dest, file string) error {
+	rel, err := filepath.Rel(dest, file)
+	if err != nil {
+		return err
+	}
+	parents := filepath.Dir(rel)
+	if parents == "." {
+		return nil
+	}
+	dir := dest
+	for _, name := range strings.Split(parents, string(filepath.Separator)) {
+		dir = filepath.Join(dir, name)
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to extract %s through symlink %s", file, dir)
+		}
+	}
+	return nil
+}
+
+// localLink reports whether a symlink target is relative and does not go up
+// the tree.
+func localLink(link string) bool {
+	if link == "" || path.IsAbs(link) {
+		return false
+	}
+	for _, name := range strings.Split(link, "/") {
+		if name == ".." {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type tarEntry struct {
+	name string
+	typ  byte
+	link string
+	body string
+}
+
+func archive(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typ, Linkname: e.link, Mode: 0644, Size: int64(len(e.body))}
+		if e.typ == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestUntarRejectsEscapes(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries func(outside string) []tarEntry
+	}{
+		{"absolute link", func(outside string) []tarEntry {
+			return []tarEntry{
+				{name: "base/", typ: tar.TypeDir},
+				{name: "base/x", typ: tar.TypeSymlink, link: outside},
+				{name: "base/x/authorized_keys", typ: tar.TypeReg, body: "key"},
+			}
+		}},
+		{"parent link", func(outside string) []tarEntry {
+			return []tarEntry{
+				{name: "base/", typ: tar.TypeDir},
+				{name: "base/x", typ: tar.TypeSymlink, link: "../../outside"},
+				{name: "base/x/authorized_keys", typ: tar.TypeReg, body: "key"},
+			}
+		}},
+		{"write through local link", func(outside string) []tarEntry {
+			return []tarEntry{
+				{name: "base/", typ: tar.TypeDir},
+				{name: "base/y/", typ: tar.TypeDir},
+				{name: "base/x", typ: tar.TypeSymlink, link: "y"},
+				{name: "base/x/authorized_keys", typ: tar.TypeReg, body: "key"},
+			}
+		}},
+		{"entry outside base", func(outside string) []tarEntry {
+			return []tarEntry{
+				{name: "base/../outside/authorized_keys", typ: tar.TypeReg, body: "key"},
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "untar")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmp)
+			outside := filepath.Join(tmp, "outside")
+			if err := os.Mkdir(outside, 0755); err != nil {
+				t.Fatal(err)
+			}
+			dest := filepath.Join(tmp, "dest", "base")
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			err = untar(archive(t, tt.entries(outside)), "base", dest)
+			if err == nil {
+				t.Errorf("untar succeeded, want an error")
+			}
+			for _, f := range []string{filepath.Join(outside, "authorized_keys"), filepath.Join(dest, "y", "authorized_keys")} {
+				if _, err := os.Lstat(f); err == nil {
+					t.Errorf("%s was written", f)
+				}
+			}
+		})
+	}
+}
+
+func TestUntar(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "untar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dest := filepath.Join(tmp, "base")
+
+	err = untar(archive(t, []tarEntry{
+		{name: "base/", typ: tar.TypeDir},
+		{name: "base/etc/", typ: tar.TypeDir},
+		{name: "base/etc/app.conf", typ: tar.TypeReg, body: "port=80"},
+		{name: "base/current", typ: tar.TypeSymlink, link: "etc/app.conf"},
+	}), "base", dest)
+	if err != nil {
+		t.Fatalf("untar failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dest, "current"))
+	if err != nil || string(data) != "port=80" {
+		t.Errorf("got %q, %v, want port=80 through the link", data, err)
+	}
+}
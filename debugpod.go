@@ -1,191 +1,804 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
+	"path"
+	"strings"
+	"sync"
 	"time"
 
 	dockerterm "github.com/docker/docker/pkg/term"
+	"github.com/josledp/debugger/agent"
 	"k8s.io/kubernetes/pkg/kubectl/util/term"
 
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/util/exec"
 )
 
+// agentBinary is where the debug image has the agent.
+const agentBinary = "/debugpod-agent"
+
+// DebugPodOptions are the optional settings of a debug session.
+type DebugPodOptions struct {
+	// Container is the container to debug, empty for the pod's default one.
+	Container string
+	// Namespaces are the namespaces of the container to enter, nil for the
+	// agent's default and empty for none.
+	Namespaces []string
+	// Selector is a label selector choosing the pod to debug.
+	Selector string
+	// Pick is the rule choosing among the pods of a workload or selector.
+	Pick string
+	// Node is the node to debug instead of a pod.
+	Node string
+	// Mode is how the debug container is run: modePod, modeEphemeral, or
+	// modeAuto to use ephemeral containers when the cluster supports them.
+	Mode string
+	// Image is the debug image.
+	Image string
+	// PullPolicy is the pull policy of the debug image.
+	PullPolicy v1.PullPolicy
+	// ImagePullSecrets are the secrets used to pull the debug image.
+	ImagePullSecrets []string
+	// Tolerations of the debug pod.
+	Tolerations []v1.Toleration
+	// PriorityClass of the debug pod.
+	PriorityClass string
+	// MaxDuration is how long the session lasts unless extended.
+	MaxDuration time.Duration
+	// IdleTimeout closes the session after this long without input from the
+	// user, zero disables it. Output does not count, a command printing
+	// continuously is not a sign of someone watching it.
+	IdleTimeout time.Duration
+	// Timeout is how long to wait for the debug container to get ready.
+	Timeout time.Duration
+	// Record is the file, or directory, to record the session in asciicast
+	// format, empty to not record it.
+	Record string
+	// RecordUpload also stores the recording in a ConfigMap.
+	RecordUpload bool
+	// SecurityProfile is what the debug container is allowed to do, empty for
+	// sysadmin.
+	SecurityProfile string
+	// Copy debugs a copy of the target pod instead, with the target container
+	// idle, so crashed and exited containers can be debugged.
+	Copy bool
+	// CopyImage replaces the image of the target container in the copy.
+	CopyImage string
+	// Chroot runs the shell in the target filesystem, with the debug image
+	// mounted in it.
+	Chroot bool
+	// AsTarget runs the shell as the user of the target process, with its
+	// capabilities, working directory and environment.
+	AsTarget bool
+	// ShowSecrets does not mask secret looking variables of the target
+	// environment with AsTarget.
+	ShowSecrets bool
+	// SkipPreflight skips the permission and admission checks done before
+	// creating the debug container.
+	SkipPreflight bool
+}
+
 type DebugPod struct {
 	targetPod       string
 	targetNamespace string
+	targetContainer string
 	targetNode      string
+	namespaces      []string
+	mode            string
+	timeout         time.Duration
+	lifetime        *lifetime
+	image           string
+	pullPolicy      v1.PullPolicy
+	pullSecrets     []string
+	tolerations     []v1.Toleration
+	priorityClass   string
+	session         string
 	podName         string
+	container       string
+	agentArgs       []string
+	resumed         bool
+	record          string
+	recordUpload    bool
+	recording       *recorder
+	recordingDone   sync.Once
+	skipPreflight   bool
+	securityProfile string
+	security        securityProfile
+	copy            bool
+	chroot          bool
+	asTarget        bool
+	showSecrets     bool
+	agentPath       string
 	pod             *v1.Pod
-	k8sConfig       *rest.Config
-	k8s             *kubernetes.Clientset
-	ctx             context.Context
+	// copyPod is the decoded JSON of the copy of the target pod.
+	copyPod   map[string]interface{}
+	ephemeral *ephemeralContainer
+	k8sConfig *rest.Config
+	k8s       *kubernetes.Clientset
+	ctx       context.Context
+
+	// stop ends the running Attach, nil when there is none.
+	stopMu sync.Mutex
+	stop   chan struct{}
 }
 
-func NewDebugPod(ctx context.Context, k8sConfig *rest.Config, namespace, targetPod string) (*DebugPod, error) {
+func NewDebugPod(ctx context.Context, k8sConfig *rest.Config, namespace, targetPod string, opts DebugPodOptions) (*DebugPod, error) {
 
 	k8sClient, err := kubernetes.NewForConfig(k8sConfig)
 	if err != nil {
 		return nil, fmt.Errorf("unable to setup client: %v", err)
 	}
 	r := rand.New(rand.NewSource(int64(time.Now().UnixNano())))
+	session := fmt.Sprintf("%08x", r.Uint32())
 
 	dp := &DebugPod{
 		targetPod:       targetPod,
 		targetNamespace: namespace,
-		podName:         fmt.Sprintf("debug-%s-%d", targetPod, r.Int63()),
+		namespaces:      opts.Namespaces,
+		session:         session,
+		timeout:         opts.Timeout,
+		lifetime:        newLifetime(opts.MaxDuration, opts.IdleTimeout),
+		image:           opts.Image,
+		pullPolicy:      opts.PullPolicy,
+		pullSecrets:     opts.ImagePullSecrets,
+		tolerations:     opts.Tolerations,
+		priorityClass:   opts.PriorityClass,
+		record:          opts.Record,
+		recordUpload:    opts.RecordUpload,
+		skipPreflight:   opts.SkipPreflight,
+		securityProfile: opts.SecurityProfile,
+		agentPath:       agentBinary,
 		k8s:             k8sClient,
 		k8sConfig:       k8sConfig,
 		ctx:             ctx,
 	}
 
-	pod, err := dp.k8s.CoreV1().Pods(namespace).Get(dp.targetPod, metav1.GetOptions{})
+	if opts.MaxDuration <= 0 || opts.MaxDuration > maxSessionLifetime {
+		return nil, fmt.Errorf("session duration must be positive and at most %v", maxSessionLifetime)
+	}
+	if dp.securityProfile == "" {
+		dp.securityProfile = securitySysadmin
+	}
+	dp.security, err = parseSecurityProfile(dp.securityProfile)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Chroot {
+		if opts.Node != "" || opts.Copy {
+			return nil, fmt.Errorf("chroot can only be used on running pods, the host root of nodes is at /host")
+		}
+		dp.chroot = true
+		if dp.namespaces == nil {
+			dp.namespaces = append([]string(nil), agent.Profiles["default"]...)
+		}
+		if !contains(dp.namespaces, "mnt") {
+			dp.namespaces = append(dp.namespaces, "mnt")
+		}
+	}
+
+	if opts.AsTarget {
+		if opts.Node != "" {
+			return nil, fmt.Errorf("as-target can only be used on pods")
+		}
+		// Switching to the target user needs CAP_SETUID and CAP_SETGID.
+		if dp.securityProfile != securitySysadmin {
+			return nil, fmt.Errorf("as-target needs the %s security profile", securitySysadmin)
+		}
+		dp.asTarget = true
+		dp.showSecrets = opts.ShowSecrets
+	}
+
+	if opts.Node != "" {
+		if opts.Copy {
+			return nil, fmt.Errorf("nodes can not be copied")
+		}
+		return dp, dp.setupNode(opts)
+	}
+
+	dp.targetPod, err = dp.resolveTarget(targetPod, opts.Selector, opts.Pick, opts.Copy)
+	if err != nil {
+		return nil, err
+	}
+	dp.podName = fmt.Sprintf("debug-%s-%s", dp.targetPod, dp.session)
+
+	raw, err := dp.k8s.CoreV1().RESTClient().Get().Namespace(namespace).Resource("pods").Name(dp.targetPod).DoRaw()
 	if err != nil {
 		return nil, fmt.Errorf("unable to get pod %s: %v", dp.targetPod, err)
 	}
+	pod, err := decodeTargetPod(raw)
+	if err != nil {
+		return nil, err
+	}
 
 	dp.targetNode = pod.Spec.NodeName
+	if opts.Copy {
+		if opts.Mode == modeEphemeral {
+			return nil, fmt.Errorf("copies of the target pod can not be debugged with ephemeral containers")
+		}
+		// The container of a copy may never have started, only its spec
+		// matters.
+		dp.targetContainer, err = pod.containerName(opts.Container)
+		if err != nil {
+			return nil, err
+		}
+		return dp, dp.setupCopy(pod, dp.targetContainer, opts.CopyImage)
+	}
+
+	status, err := pod.containerStatus(opts.Container)
+	if err != nil {
+		return nil, err
+	}
+	dp.targetContainer = status.Name
+	dp.mode, err = dp.selectMode(opts.Mode, len(opts.ImagePullSecrets) > 0)
+	if err != nil {
+		return nil, err
+	}
+	dp.namespaces, err = dp.security.agentNamespaces(dp.securityProfile, dp.namespaces)
+	if err != nil {
+		return nil, err
+	}
+	if dp.mode == modeEphemeral {
+		dp.podName = dp.targetPod
+		dp.container = "debugpod-" + dp.session
+		dp.ephemeral, err = dp.ephemeralContainer(pod, status)
+		if err != nil {
+			return nil, err
+		}
+		return dp, nil
+	}
+
+	runtime, containerID, err := parseContainerID(status.ContainerID)
+	if err != nil {
+		return nil, err
+	}
+	if !dp.security.hostPID {
+		return nil, fmt.Errorf("security profile %s needs ephemeral containers", dp.securityProfile)
+	}
+	if !dp.security.runtimeSocket {
+		// Without the runtime socket the agent finds the target in the cgroups
+		// of the host processes.
+		dp.pod = dp.newPod(
+			[]v1.EnvVar{
+				v1.EnvVar{Name: "CONTAINER_ID", Value: containerID},
+				v1.EnvVar{Name: "CONTAINER_RUNTIME", Value: "cgroup"},
+			},
+			nil,
+			nil,
+		)
+		return dp, nil
+	}
+	// Unchecked, as the socket is elsewhere on some distributions, e.g. k3s,
+	// and the agent then falls back to the cgroups of the host processes.
+	hostPathType := v1.HostPathUnset
+
+	dp.pod = dp.newPod(
+		[]v1.EnvVar{
+			v1.EnvVar{Name: "CONTAINER_ID", Value: containerID},
+			v1.EnvVar{Name: "CONTAINER_RUNTIME", Value: runtime.name},
+			v1.EnvVar{Name: "RUNTIME_ENDPOINT", Value: runtime.socket},
+		},
+		[]v1.VolumeMount{
+			v1.VolumeMount{Name: "runtimesock", MountPath: runtime.socket},
+		},
+		[]v1.Volume{
+			v1.Volume{Name: "runtimesock", VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: runtime.socket, Type: &hostPathType}}},
+		},
+	)
+
+	return dp, nil
+}
+
+// setupNode prepares a debug pod targeting the node itself: the agent joins
+// the namespaces of the host's PID 1 and the host root is mounted at /host.
+func (dp *DebugPod) setupNode(opts DebugPodOptions) error {
+	node := opts.Node
+	if dp.targetPod != "" || opts.Selector != "" {
+		return fmt.Errorf("a pod and a node can not be debugged at the same time")
+	}
+	if opts.Mode == modeEphemeral {
+		return fmt.Errorf("nodes can not be debugged with ephemeral containers")
+	}
+	if contains(dp.namespaces, "mnt") {
+		return fmt.Errorf("the host mount namespace can not be entered, the host root is available at /host")
+	}
+	if !dp.security.privileged {
+		// Debugging the node is root on it whatever the capabilities.
+		return fmt.Errorf("security profile %s can not debug nodes", dp.securityProfile)
+	}
+	_, err := dp.k8s.CoreV1().Nodes().Get(node, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to get node %s: %v", node, err)
+	}
+	dp.targetNode = node
+	dp.mode = modePod
+	dp.podName = fmt.Sprintf("debug-node-%s-%s", node, dp.session)
+	dp.agentArgs = []string{"-pid", "1"}
+
+	hostPathType := v1.HostPathDirectory
+	dp.pod = dp.newPod(
+		nil,
+		[]v1.VolumeMount{
+			v1.VolumeMount{Name: "host", MountPath: "/host"},
+		},
+		[]v1.Volume{
+			v1.Volume{Name: "host", VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/", Type: &hostPathType}}},
+		},
+	)
+	return nil
+}
+
+// newPod builds the debug pod bound to the target node.
+func (dp *DebugPod) newPod(env []v1.EnvVar, mounts []v1.VolumeMount, volumes []v1.Volume) *v1.Pod {
+	dp.container = "debugpod"
+	automountToken := false
+	// Node sessions of unprivileged profiles run in the host network instead
+	// of joining it.
+	hostNetwork := dp.security.hostNetwork || (dp.targetPod == "" && dp.security.hostPID)
+
+	var pullSecrets []v1.LocalObjectReference
+	for _, s := range dp.pullSecrets {
+		pullSecrets = append(pullSecrets, v1.LocalObjectReference{Name: s})
+	}
 
-	privilegeEscalation := true
-	privileged := true
-	containerID := pod.Status.ContainerStatuses[0].ContainerID
-	hostPathType := v1.HostPathFile
+	// The watchdog reads the heartbeat from the annotations exposed by the
+	// downward API, and makes the pod terminate when the client is gone.
+	mounts = append(mounts, v1.VolumeMount{Name: annotationsVolumeName, MountPath: path.Dir(agent.AnnotationsFile)})
+	volumes = append(volumes, v1.Volume{Name: annotationsVolumeName, VolumeSource: v1.VolumeSource{DownwardAPI: &v1.DownwardAPIVolumeSource{
+		Items: []v1.DownwardAPIVolumeFile{
+			v1.DownwardAPIVolumeFile{Path: path.Base(agent.AnnotationsFile), FieldRef: &v1.ObjectFieldSelector{FieldPath: "metadata.annotations"}},
+		},
+	}}})
+	deadline := int64(maxSessionLifetime.Seconds())
+	labels, annotations := dp.sessionMeta()
+	dp.security.podAnnotations(annotations, dp.container)
 
-	dp.pod = &v1.Pod{
+	return &v1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      dp.podName,
-			Namespace: dp.targetNamespace,
+			Name:        dp.podName,
+			Namespace:   dp.targetNamespace,
+			Labels:      labels,
+			Annotations: annotations,
 		},
 		Spec: v1.PodSpec{
-			HostIPC:     true,
-			HostPID:     true,
-			HostNetwork: true,
+			RestartPolicy:         v1.RestartPolicyNever,
+			ActiveDeadlineSeconds: &deadline,
+			HostIPC:               dp.security.hostIPC,
+			HostPID:               dp.security.hostPID,
+			HostNetwork:           hostNetwork,
+			// The debug pod never talks to the API server.
+			AutomountServiceAccountToken: &automountToken,
 			Containers: []v1.Container{
 				v1.Container{
-					Name:            "debugpod",
-					Image:           "josledp/debugpod",
-					ImagePullPolicy: v1.PullAlways,
-					//					Args:  []string{containerID},
-					Env: []v1.EnvVar{
-						v1.EnvVar{Name: "CONTAINER_ID", Value: containerID},
-					},
-					SecurityContext: &v1.SecurityContext{
-						AllowPrivilegeEscalation: &privilegeEscalation,
-						Privileged:               &privileged,
-					},
-					VolumeMounts: []v1.VolumeMount{
-						v1.VolumeMount{Name: "dockersock", MountPath: "/var/run/docker.sock"},
-					},
+					Name:            dp.container,
+					Image:           dp.image,
+					ImagePullPolicy: dp.pullPolicy,
+					Command:         []string{agentBinary, "watchdog", "-grace", heartbeatGrace.String()},
+					Env:             env,
+					SecurityContext: dp.security.securityContext(),
+					VolumeMounts:    mounts,
+					Resources:       debugResources,
 				},
 			},
-			Volumes: []v1.Volume{
-				v1.Volume{Name: "dockersock", VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/var/run/docker.sock", Type: &hostPathType}}},
-			},
-			NodeSelector: map[string]string{
-				"kubernetes.io/hostname": dp.targetNode,
-			},
+			Volumes:          volumes,
+			ImagePullSecrets: pullSecrets,
+			// Binding to the node skips the scheduler, so cordoned and NotReady
+			// nodes can be debugged too.
+			NodeName:          dp.targetNode,
+			Tolerations:       dp.tolerations,
+			PriorityClassName: dp.priorityClass,
 		},
 	}
-
-	return dp, nil
 }
 
-func (dp *DebugPod) waitForPod(timeout int) error {
-	var i int
-	for i = 0; i < timeout; i++ {
-		status, err := dp.k8s.CoreV1().Pods(dp.targetNamespace).Get(dp.podName, metav1.GetOptions{})
-		if err != nil {
-			return fmt.Errorf("unable to retrieve pod status: %v", err)
-		}
-		if status.Status.Phase == "Running" {
-			break
-		}
-		select {
-		case <-dp.ctx.Done():
-			dp.Clean(nil)
-			return fmt.Errorf("exited because requested")
-		default:
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
 		}
-		time.Sleep(1 * time.Second)
 	}
-	for ; i < timeout; i++ {
-		status, err := dp.k8s.CoreV1().Pods(dp.targetNamespace).Get(dp.podName, metav1.GetOptions{})
-		if err != nil {
-			return fmt.Errorf("unable to retrieve pod status: %v", err)
-		}
-		if status.Status.ContainerStatuses[0].Ready {
-			return nil
-		}
-		select {
-		case <-dp.ctx.Done():
-			dp.Clean(nil)
-			return fmt.Errorf("exited because requested")
-		default:
-		}
-		time.Sleep(1 * time.Second)
-	}
-	return fmt.Errorf("Pod not ready after %d seconds", timeout)
+	return false
 }
 
 func (dp *DebugPod) Create() (<-chan struct{}, error) {
+	if !dp.skipPreflight {
+		if err := dp.preflight(); err != nil {
+			return nil, err
+		}
+	}
 	var err error
-	dp.pod, err = dp.k8s.CoreV1().Pods(dp.targetNamespace).Create(dp.pod)
-	if err != nil {
-		return nil, fmt.Errorf("error creating debugPod: %v", err)
+	if dp.mode == modeEphemeral {
+		err = dp.createEphemeral(false)
+		if err != nil {
+			return nil, createError("error creating ephemeral container", err)
+		}
+	} else {
+		dp.pod, err = dp.createPod()
+		if err != nil {
+			return nil, createError("error creating debugPod", err)
+		}
 	}
 
-	err = dp.waitForPod(60)
+	err = dp.waitForContainer(dp.timeout)
 
 	if err != nil {
 		err2 := dp.Clean(nil)
 		if err2 != nil {
 			return nil, fmt.Errorf("debugPod did not get ready status: %v\nFurthermore there was an error cleaning the pod %s: %v", err, dp.podName, err2)
 		}
+		if _, ok := err.(*StartError); ok {
+			return nil, err
+		}
 		return nil, fmt.Errorf("debugPod did not get ready status: %v", err)
 	}
+	return dp.manage(), nil
+}
+
+// createPod creates the debug pod.
+func (dp *DebugPod) createPod() (*v1.Pod, error) {
+	body, err := dp.podBody()
+	if err != nil {
+		return nil, err
+	}
+	pod := &v1.Pod{}
+	err = dp.k8s.CoreV1().RESTClient().Post().
+		Namespace(dp.targetNamespace).Resource("pods").
+		Body(body).Do().Into(pod)
+	return pod, err
+}
+
+// podBody encodes the debug pod with the securityContext of the debug
+// container confined by its security profile, which v1.Pod can not carry.
+// Copies keep the securityContext of the target.
+func (dp *DebugPod) podBody() ([]byte, error) {
+	if dp.copy {
+		return json.Marshal(dp.copyPod)
+	}
+	raw, err := json.Marshal(dp.pod)
+	if err != nil {
+		return nil, err
+	}
+	var pod map[string]interface{}
+	if err := json.Unmarshal(raw, &pod); err != nil {
+		return nil, err
+	}
+	spec, _ := pod["spec"].(map[string]interface{})
+	containers, _ := spec["containers"].([]interface{})
+	for _, c := range containers {
+		if c, ok := c.(map[string]interface{}); ok && c["name"] == dp.container {
+			c["securityContext"] = dp.security.confinedSecurityContext()
+		}
+	}
+	return json.Marshal(pod)
+}
+
+// manage keeps the debug pod alive until the context is done, and then
+// cleans it. The returned channel is closed once it is cleaned.
+func (dp *DebugPod) manage() <-chan struct{} {
+	go dp.heartbeat()
 	end := make(chan struct{})
 	go func() {
 		<-dp.ctx.Done()
+		dp.finishRecording()
 		dp.Clean(end)
 	}()
-	return end, nil
+	return end
 }
 
 func (dp *DebugPod) Clean(end chan<- struct{}) error {
-	err := dp.k8s.CoreV1().Pods(dp.targetNamespace).Delete(dp.podName, &metav1.DeleteOptions{})
+	var err error
+	if dp.mode == modeEphemeral {
+		// podName is the target pod here, it must never be deleted.
+		err = dp.cleanEphemeral()
+	} else {
+		err = dp.k8s.CoreV1().Pods(dp.targetNamespace).Delete(dp.podName, &metav1.DeleteOptions{})
+	}
 	if end != nil {
 		close(end)
 	}
 	return err
 }
 
-func (dp *DebugPod) Attach() error {
+// createError reports admission rejections, such as PodSecurity ones, as a
+// StartError.
+func createError(msg string, err error) error {
+	if errors.IsForbidden(err) || errors.IsInvalid(err) {
+		return &StartError{Reason: ReasonForbidden, Message: fmt.Sprintf("%s: %v", msg, err)}
+	}
+	return fmt.Errorf("%s: %v", msg, err)
+}
 
+// executor returns an executor running command in the debug container.
+func (dp *DebugPod) executor(command []string, stdin, tty bool) (remotecommand.Executor, error) {
 	req := dp.k8s.CoreV1().RESTClient().Post().Resource("pods").Name(dp.podName).Namespace(dp.targetNamespace).SubResource("exec")
-	req = req.Param("container", "debugpod")
-	req = req.Param("command", "/entrypoint.sh")
-	req = req.Param("stdin", "true")
+	req = req.Param("container", dp.container)
+	for _, c := range command {
+		req = req.Param("command", c)
+	}
+	if stdin {
+		req = req.Param("stdin", "true")
+	}
 	req = req.Param("stdout", "true")
-	req = req.Param("tty", "true")
+	if tty {
+		req = req.Param("tty", "true")
+	} else {
+		req = req.Param("stderr", "true")
+	}
 
 	executor, err := remotecommand.NewSPDYExecutor(dp.k8sConfig, "POST", req.URL())
 	if err != nil {
-		return fmt.Errorf("unable to create executor: %v", err)
+		return nil, fmt.Errorf("unable to create executor: %v", err)
 	}
+	return executor, nil
+}
+
+// agentCommand returns the command line of the agent.
+func (dp *DebugPod) agentCommand() []string {
+	command := append([]string{dp.agentPath}, dp.agentArgs...)
+	if dp.chroot {
+		command = append(command, "-chroot")
+	}
+	if dp.asTarget {
+		command = append(command, "-as-target")
+	}
+	if dp.showSecrets {
+		command = append(command, "-show-secrets")
+	}
+	switch {
+	case dp.namespaces == nil:
+	case len(dp.namespaces) == 0:
+		command = append(command, "-namespaces", agent.NoNamespaces)
+	default:
+		command = append(command, "-namespaces", strings.Join(dp.namespaces, ","))
+	}
+	return command
+}
+
+// Attach runs an interactive shell in the target. In persistent sessions the
+// shell survives connection losses, and the user can detach from it with
+// Ctrl-P Ctrl-Q, in which case errDetached is returned. If the connection can not be
+// recovered a *connectionLostError is returned, and errStopped if Stop was
+// called.
+func (dp *DebugPod) Attach() error {
 	stdin, stdout, _ := dockerterm.StdStreams()
 
 	t := term.TTY{
 		Out: stdout,
 		In:  stdin,
+		Raw: true,
+	}
+
+	if err := dp.startRecording(t.GetSize()); err != nil {
+		return err
+	}
+	command := dp.agentCommand()
+	if dp.persistent() {
+		command = append(command, "-persist", dp.session)
+	}
+	if dp.copy {
+		command = append(append(command, "--"), copyShell...)
+	}
+	if dp.resumed {
+		command = dp.reattachCommand()
+	}
+	// Only persistent sessions can be detached from, the detach keys go to
+	// the shell otherwise.
+	in := dp.recordReader(activityReader{t.In, dp.lifetime})
+	var detached <-chan struct{}
+	if dp.persistent() {
+		escape := newEscapeReader(in)
+		in, detached = escape, escape.detached
+	}
+	pump := newInputPump(in)
+	out := newMarkerWriter(dp.recordWriter(t.Out))
+
+	stop := make(chan struct{})
+	dp.stopMu.Lock()
+	dp.stop = stop
+	dp.stopMu.Unlock()
+	defer func() {
+		dp.stopMu.Lock()
+		dp.stop = nil
+		dp.stopMu.Unlock()
+	}()
+
+	return t.Safe(func() error {
+		terminalSize := t.MonitorSize(t.GetSize())
+		delay := time.Second
+		for attempt := 0; ; attempt++ {
+			out.reset()
+			input := pump.next()
+			err := dp.stream(command, input, detached, out, terminalSize, stop)
+			input.Close()
+			out.Flush()
+			if out.err != nil {
+				return out.err
+			}
+			if err == nil || err == errDetached || err == errStopped {
+				return err
+			}
+			if _, ok := err.(exec.CodeExitError); ok || !dp.persistent() {
+				return err
+			}
+			if attempt == maxReconnects {
+				return &connectionLostError{session: dp.session, err: err}
+			}
+			fmt.Fprintf(t.Out, "\r\ndebugpod: connection lost (%v), reconnecting in %v\r\n", err, delay)
+			select {
+			case <-time.After(delay):
+			case <-stop:
+				return errStopped
+			}
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+			command = dp.reattachCommand()
+		}
+	})
+}
+
+// Stop makes the running Attach return errStopped, restoring the terminal. It
+// returns false if there is no Attach running.
+func (dp *DebugPod) Stop() bool {
+	dp.stopMu.Lock()
+	defer dp.stopMu.Unlock()
+	if dp.stop == nil {
+		return false
+	}
+	close(dp.stop)
+	dp.stop = nil
+	return true
+}
+
+// reattachCommand returns the command line of the agent attaching to the
+// shell of the session.
+func (dp *DebugPod) reattachCommand() []string {
+	return []string{dp.agentPath, "-reattach", dp.session}
+}
+
+// stream runs command with a TTY until it ends, detached is closed by the
+// user detaching or stop is closed.
+func (dp *DebugPod) stream(command []string, in io.Reader, detached <-chan struct{}, out io.Writer, terminalSize remotecommand.TerminalSizeQueue, stop <-chan struct{}) error {
+	executor, err := dp.executor(command, true, true)
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- executor.Stream(remotecommand.StreamOptions{
+			Tty:               true,
+			Stdin:             in,
+			Stdout:            out,
+			TerminalSizeQueue: terminalSize,
+		})
+	}()
+	select {
+	case err := <-done:
+		select {
+		case <-detached:
+			// The end of the input after the detach keys may end the stream.
+			return errDetached
+		default:
+		}
+		return err
+	case <-detached:
+		return errDetached
+	case <-stop:
+		return errStopped
+	}
+}
+
+// Exec runs command in the target without a TTY and returns its exit code.
+// It is recorded if the session is.
+func (dp *DebugPod) Exec(command []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	if err := dp.startRecording(nil); err != nil {
+		return 0, err
+	}
+	return dp.exec(command, dp.recordReader(stdin), dp.recordWriter(stdout), dp.recordWriter(stderr))
+}
+
+// ExecUnrecorded is Exec for streams that are not terminal output, such as
+// pcap data or forwarded connections. It is never recorded, so it can run
+// concurrently.
+func (dp *DebugPod) ExecUnrecorded(command []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	return dp.exec(command, stdin, stdout, stderr)
+}
+
+func (dp *DebugPod) exec(command []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	args := append(dp.agentCommand(), "--")
+	executor, err := dp.executor(append(args, command...), stdin != nil, false)
+	if err != nil {
+		return 0, err
+	}
+	if stdin != nil {
+		stdin = activityReader{stdin, dp.lifetime}
+	}
+	errOut := newMarkerWriter(stderr)
+	err = executor.Stream(remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: errOut,
+	})
+	errOut.Flush()
+	if errOut.err != nil {
+		return 0, errOut.err
+	}
+	if err == nil {
+		return 0, nil
+	}
+	if exitErr, ok := err.(exec.CodeExitError); ok {
+		return exitErr.Code, nil
+	}
+	return 0, err
+}
+
+// markerWriter writes through everything but the line the agent reports its
+// failure with, which it keeps as err: the exit code alone can not tell the
+// agent failing from the command exiting with the same code. The agent fails
+// before the command writes anything, so only the first line is looked at.
+type markerWriter struct {
+	w       io.Writer
+	checked bool
+	pending []byte
+	err     *agent.Error
+}
+
+func newMarkerWriter(w io.Writer) *markerWriter {
+	return &markerWriter{w: w}
+}
+
+func (m *markerWriter) Write(p []byte) (int, error) {
+	if m.checked {
+		return m.w.Write(p)
+	}
+	data := append(m.pending, p...)
+	m.pending = nil
+	if agent.IsMarkerPrefix(data) {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			// Wait for the rest of the line to tell.
+			m.pending = data
+			return len(p), nil
+		}
+		if m.err = agent.ParseMarker(string(data[:i])); m.err != nil {
+			data = data[i+1:]
+		}
 	}
+	m.checked = true
+	_, err := m.w.Write(data)
+	return len(p), err
+}
 
-	terminalSize := t.MonitorSize(t.GetSize())
+// Flush writes what was held back waiting for the end of the first line,
+// unless it is a marker the stream ended before the newline of.
+func (m *markerWriter) Flush() error {
+	data := m.pending
+	m.pending = nil
+	if len(data) == 0 {
+		return nil
+	}
+	if m.err = agent.ParseMarker(string(data)); m.err != nil {
+		return nil
+	}
+	_, err := m.w.Write(data)
+	return err
+}
 
-	return executor.Stream(remotecommand.StreamOptions{Tty: true, Stdin: t.In, Stdout: t.Out, TerminalSizeQueue: terminalSize})
+// reset starts looking for the marker again, in a new stream.
+func (m *markerWriter) reset() {
+	m.checked = false
+	m.pending = nil
+	m.err = nil
 }
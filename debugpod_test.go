@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/josledp/debugger/agent"
+)
+
+func TestMarkerWriter(t *testing.T) {
+	marker := agent.Errorf(agent.ErrConnect, "dial tcp: refused").Marker()
+	tests := []struct {
+		name   string
+		writes []string
+		out    string
+		err    *agent.Error
+	}{
+		{"output", []string{"hello\n", "world\n"}, "hello\nworld\n", nil},
+		{"marker", []string{marker}, "", agent.ErrConnect},
+		{"marker then output", []string{marker + "after\n"}, "after\n", agent.ErrConnect},
+		{"split marker", []string{marker[:5], marker[5:20], marker[20:]}, "", agent.ErrConnect},
+		{"byte by byte", splitBytes(marker + "x"), "x", agent.ErrConnect},
+		{"terminal marker", []string{marker[:len(marker)-1] + "\r\n", "$ "}, "$ ", agent.ErrConnect},
+		{"missing newline", []string{marker[:len(marker)-1]}, "", agent.ErrConnect},
+		{"looks like the marker", []string{"debug", "pod-agent error nope\n", "x"}, "debugpod-agent error nope\nx", nil},
+		{"unknown code", []string{"debugpod-agent error 1: no\n"}, "debugpod-agent error 1: no\n", nil},
+		{"prefix without newline", []string{"debugpod"}, "debugpod", nil},
+		{"marker after output", []string{"hello\n", marker}, "hello\n" + marker, nil},
+		{"nothing", nil, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			m := newMarkerWriter(&out)
+			for _, w := range tt.writes {
+				if n, err := m.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", w, n, err)
+				}
+			}
+			if err := m.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.out {
+				t.Errorf("got output %q, want %q", out.String(), tt.out)
+			}
+			if (m.err == nil) != (tt.err == nil) || (m.err != nil && m.err.Code != tt.err.Code) {
+				t.Errorf("got error %v, want %v", m.err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMarkerWriterReset(t *testing.T) {
+	var out bytes.Buffer
+	m := newMarkerWriter(&out)
+	m.Write([]byte("hello\n"))
+	m.reset()
+	m.Write([]byte(agent.ErrSessionGone.Marker()))
+	m.Flush()
+	if m.err == nil || m.err.Code != agent.ErrSessionGone.Code || out.String() != "hello\n" {
+		t.Errorf("got %q, %v after reset, want the marker of the new stream", out.String(), m.err)
+	}
+}
+
+func splitBytes(s string) []string {
+	var parts []string
+	for i := range s {
+		parts = append(parts, s[i:i+1])
+	}
+	return parts
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/josledp/debugger/agent"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// errDetached is returned by Attach when the user types the detach keys.
+var errDetached = errors.New("detached")
+
+// errStopped is returned by Attach when Stop is called.
+var errStopped = errors.New("stopped")
+
+// connectionLostError is returned by Attach when the connection to a
+// persistent session could not be recovered. The shell is still running.
+type connectionLostError struct {
+	session string
+	err     error
+}
+
+func (e *connectionLostError) Error() string {
+	return fmt.Sprintf("connection to session %s lost: %v", e.session, e.err)
+}
+
+// detachKeys are Ctrl-P Ctrl-Q, as in docker.
+var detachKeys = []byte{0x10, 0x11}
+
+const (
+	maxReconnects     = 6
+	maxReconnectDelay = 30 * time.Second
+)
+
+// escapeReader passes input through, closing detached when the detach keys
+// are typed, once what was typed before them is read. A lone first detach key
+// is held until the next byte arrives.
+type escapeReader struct {
+	r         io.Reader
+	detached  chan struct{}
+	detaching bool
+	matched   int
+	pending   []byte
+}
+
+func newEscapeReader(r io.Reader) *escapeReader {
+	return &escapeReader{r: r, detached: make(chan struct{})}
+}
+
+func (e *escapeReader) Read(p []byte) (int, error) {
+	for len(e.pending) == 0 {
+		if e.detaching {
+			select {
+			case <-e.detached:
+			default:
+				close(e.detached)
+			}
+			return 0, io.EOF
+		}
+		buf := make([]byte, len(p))
+		n, err := e.r.Read(buf)
+		for _, b := range buf[:n] {
+			if b == detachKeys[e.matched] {
+				e.matched++
+				if e.matched == len(detachKeys) {
+					// Anything typed after the detach keys is dropped.
+					e.detaching = true
+					break
+				}
+				continue
+			}
+			// A failed match passes its keys through, but b may start a new
+			// one, as in Ctrl-P Ctrl-P Ctrl-Q.
+			e.pending = append(e.pending, detachKeys[:e.matched]...)
+			e.matched = 0
+			if b == detachKeys[0] {
+				e.matched = 1
+				continue
+			}
+			e.pending = append(e.pending, b)
+		}
+		if err != nil && !e.detaching && len(e.pending) == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, e.pending)
+	e.pending = e.pending[n:]
+	return n, nil
+}
+
+// inputPump reads the input of an Attach in a single goroutine, and hands it
+// to one stream at a time. client-go leaves the stdin copy of a stream
+// blocked reading after the stream ends, so streams can not share a reader.
+type inputPump struct {
+	sync.Mutex
+	current *io.PipeWriter
+	err     error
+	ready   chan struct{}
+}
+
+func newInputPump(r io.Reader) *inputPump {
+	p := &inputPump{ready: make(chan struct{}, 1)}
+	go p.run(r)
+	return p
+}
+
+// next returns the input of a new stream. Closing it hands the input back
+// to the pump, which holds it until the next stream.
+func (p *inputPump) next() *io.PipeReader {
+	r, w := io.Pipe()
+	p.Lock()
+	defer p.Unlock()
+	if p.current != nil {
+		p.current.Close()
+	}
+	if p.err != nil {
+		w.CloseWithError(p.err)
+		return r
+	}
+	p.current = w
+	select {
+	case p.ready <- struct{}{}:
+	default:
+	}
+	return r
+}
+
+func (p *inputPump) run(r io.Reader) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		for data := buf[:n]; len(data) > 0; {
+			p.Lock()
+			w := p.current
+			p.Unlock()
+			if w == nil {
+				<-p.ready
+				continue
+			}
+			written, werr := w.Write(data)
+			data = data[written:]
+			if werr != nil {
+				// The stream is gone, the rest is for the next one.
+				p.Lock()
+				if p.current == w {
+					p.current = nil
+				}
+				p.Unlock()
+			}
+		}
+		if err != nil {
+			p.Lock()
+			p.err = err
+			if p.current != nil {
+				p.current.CloseWithError(err)
+			}
+			p.Unlock()
+			return
+		}
+	}
+}
+
+// persistent tells if the shell outlives its connection, so the session can
+// be detached from and reconnected to.
+func (dp *DebugPod) persistent() bool {
+	return dp.mode == modePod && !dp.copy
+}
+
+// Detach leaves the debug pod running without a client, until it expires.
+func (dp *DebugPod) Detach() error {
+	if !dp.persistent() {
+		return fmt.Errorf("session %s can not be detached from, only debug pods of the target itself can", dp.session)
+	}
+	return dp.annotate(map[string]interface{}{agent.DetachedAnnotation: "true"})
+}
+
+// Resume takes over a detached debug pod, like Create does for a new one.
+func (dp *DebugPod) Resume() (<-chan struct{}, error) {
+	err := dp.annotate(map[string]interface{}{agent.DetachedAnnotation: nil})
+	if err != nil {
+		return nil, fmt.Errorf("unable to resume session %s: %v", dp.session, err)
+	}
+	return dp.manage(), nil
+}
+
+// annotate patches the annotations of the debug pod, nil values remove them.
+func (dp *DebugPod) annotate(annotations map[string]interface{}) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = dp.k8s.CoreV1().Pods(dp.targetNamespace).Patch(dp.podName, types.StrategicMergePatchType, patch)
+	return err
+}
+
+// ResumeDebugPod returns the DebugPod of a detached session, or of an attached
+// one with force, taking it over from its client.
+func ResumeDebugPod(ctx context.Context, k8sConfig *rest.Config, session string, force bool, opts DebugPodOptions) (*DebugPod, error) {
+	k8sClient, err := kubernetes.NewForConfig(k8sConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to setup client: %v", err)
+	}
+	pod, err := findSession(k8sClient, session)
+	if err != nil {
+		return nil, err
+	}
+	if pod.Status.Phase != v1.PodRunning {
+		return nil, fmt.Errorf("session %s is %s", session, pod.Status.Phase)
+	}
+	if pod.Annotations[agent.DetachedAnnotation] != "true" && !force {
+		return nil, fmt.Errorf("session %s is attached, use -force to take it over", session)
+	}
+
+	dp := &DebugPod{
+		targetPod:       pod.Labels[labelTargetPod],
+		targetNamespace: pod.Namespace,
+		targetNode:      pod.Spec.NodeName,
+		mode:            modePod,
+		session:         session,
+		podName:         pod.Name,
+		container:       "debugpod",
+		agentPath:       agentBinary,
+		resumed:         true,
+		pod:             pod,
+		lifetime:        newLifetime(maxSessionLifetime, opts.IdleTimeout),
+		record:          opts.Record,
+		recordUpload:    opts.RecordUpload,
+		k8s:             k8sClient,
+		k8sConfig:       k8sConfig,
+		ctx:             ctx,
+	}
+	dp.updateExpires(pod)
+	return dp, nil
+}
+
+func listCommand(args []string) {
+	fg := flag.NewFlagSet(commandName+" list", flag.ExitOnError)
+	cf := addClientFlags(fg)
+	allNamespaces := fg.Bool("all-namespaces", true, "(optional) list sessions in every namespace, not only in -namespace")
+
+	err := fg.Parse(args)
+	if err != nil {
+		log.Fatalf("unable to parse args: %v", err)
+	}
+
+	k8s, err := kubernetes.NewForConfig(cf.config())
+	if err != nil {
+		log.Fatalf("unable to setup client: %v", err)
+	}
+	namespace := cf.namespace()
+	if *allNamespaces {
+		namespace = metav1.NamespaceAll
+	}
+	pods, err := k8s.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: labelManagedBy + "=" + managedBy})
+	if err != nil {
+		log.Fatalf("unable to list debug pods: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SESSION\tNAMESPACE\tTARGET\tOWNER\tSTATUS\tAGE\tEXPIRES IN")
+	for _, pod := range pods.Items {
+		status := string(pod.Status.Phase)
+		if pod.Status.Phase == v1.PodRunning {
+			status = "attached"
+			if pod.Annotations[agent.DetachedAnnotation] == "true" {
+				status = "detached"
+			}
+		}
+		expiresIn := "-"
+		if expires, err := time.Parse(time.RFC3339, pod.Annotations[agent.ExpiresAnnotation]); err == nil {
+			expiresIn = time.Until(expires).Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			pod.Labels[labelSession],
+			pod.Namespace,
+			pod.Annotations[annotationTarget],
+			pod.Annotations[annotationOwner],
+			status,
+			time.Since(pod.CreationTimestamp.Time).Round(time.Second),
+			expiresIn,
+		)
+	}
+	w.Flush()
+}
+
+func attachCommand(args []string) {
+	fg := flag.NewFlagSet(commandName+" attach", flag.ExitOnError)
+	fg.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s attach [options] <session>\n", commandName)
+		fg.PrintDefaults()
+	}
+	cf := addClientFlags(fg)
+	rf := addRecordFlags(fg)
+	idleTimeout := fg.Duration("idle-timeout", 0, "(optional) close the session after this long without terminal input, 0 to disable")
+	force := fg.Bool("force", false, "(optional) attach to the session even if it is not detached, e.g. when its client was killed")
+
+	err := fg.Parse(args)
+	if err != nil {
+		log.Fatalf("unable to parse args: %v", err)
+	}
+	if fg.NArg() != 1 {
+		fg.Usage()
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := DebugPodOptions{IdleTimeout: *idleTimeout}
+	opts.Record, opts.RecordUpload = rf.options()
+	debugPod, err := ResumeDebugPod(ctx, cf.config(), fg.Arg(0), *force, opts)
+	if err != nil {
+		log.Printf("%v", err)
+		exit(cancel, nil, 1)
+	}
+	end, err := debugPod.Resume()
+	if err != nil {
+		log.Printf("%v", err)
+		exit(cancel, nil, 1)
+	}
+	superviseDebugPod(debugPod, cancel, end)
+	attach(debugPod, cancel, end)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// chunkReader returns one chunk per Read.
+type chunkReader struct {
+	chunks []string
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.chunks[0])
+	if c.chunks[0] = c.chunks[0][n:]; c.chunks[0] == "" {
+		c.chunks = c.chunks[1:]
+	}
+	return n, nil
+}
+
+func TestEscapeReader(t *testing.T) {
+	const p, q = "\x10", "\x11"
+	tests := []struct {
+		name     string
+		chunks   []string
+		out      string
+		detached bool
+	}{
+		{"plain input", []string{"ls\r", "exit\r"}, "ls\rexit\r", false},
+		{"detach", []string{p + q}, "", true},
+		{"detach split", []string{"ls", p, q, "lost"}, "ls", true},
+		{"detach after input", []string{"ls\r" + p + q + "lost"}, "ls\r", true},
+		{"lone ctrl-p", []string{p + "a"}, p + "a", false},
+		{"lone ctrl-p split", []string{p, "a"}, p + "a", false},
+		{"ctrl-q alone", []string{q + "a"}, q + "a", false},
+		{"ctrl-p ctrl-p ctrl-q", []string{p + p + q}, p, true},
+		{"ctrl-p ctrl-p ctrl-q split", []string{p, p, q}, p, true},
+		{"ctrl-p ctrl-p a", []string{p + p + "a"}, p + p + "a", false},
+		{"ctrl-q ctrl-p ctrl-q", []string{q + p + q}, q, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEscapeReader(&chunkReader{chunks: tt.chunks})
+			var out []byte
+			buf := make([]byte, 8)
+			for {
+				n, err := e.Read(buf)
+				out = append(out, buf[:n]...)
+				if err != nil {
+					break
+				}
+			}
+			if string(out) != tt.out {
+				t.Errorf("got %q, want %q", out, tt.out)
+			}
+			detached := false
+			select {
+			case <-e.detached:
+				detached = true
+			default:
+			}
+			if detached != tt.detached {
+				t.Errorf("got detached %v, want %v", detached, tt.detached)
+			}
+			if n, err := e.Read(buf); detached && (n != 0 || err != io.EOF) {
+				t.Errorf("Read after detaching = %d, %v, want EOF", n, err)
+			}
+		})
+	}
+}
+
+func TestEscapeReaderLargeInput(t *testing.T) {
+	input := make([]byte, 100000)
+	for i := range input {
+		input[i] = byte('a' + i%26)
+	}
+	out, err := ioutil.ReadAll(newEscapeReader(&chunkReader{chunks: []string{string(input)}}))
+	if err != nil || string(out) != string(input) {
+		t.Errorf("got %d bytes, %v, want the %d bytes of input", len(out), err, len(input))
+	}
+}
+
+func TestInputPump(t *testing.T) {
+	r, w := io.Pipe()
+	pump := newInputPump(r)
+
+	first := pump.next()
+	go w.Write([]byte("ls\n"))
+	buf := make([]byte, 16)
+	if n, err := first.Read(buf); err != nil || string(buf[:n]) != "ls\n" {
+		t.Fatalf("first stream: got %q, %v", buf[:n], err)
+	}
+	// The stream is gone: what is typed meanwhile waits for the next one.
+	first.Close()
+	go func() {
+		w.Write([]byte("pwd\n"))
+		w.Close()
+	}()
+	second := pump.next()
+	got, err := ioutil.ReadAll(second)
+	if err != nil || string(got) != "pwd\n" {
+		t.Errorf("second stream: got %q, %v", got, err)
+	}
+	if n, err := pump.next().Read(buf); err != io.EOF {
+		t.Errorf("after the end of the input: got %q, %v, want EOF", buf[:n], err)
+	}
+}
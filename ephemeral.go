@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/josledp/debugger/agent"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+const (
+	modeAuto      = "auto"
+	modePod       = "pod"
+	modeEphemeral = "ephemeral"
+)
+
+const ephemeralPIDFile = "/tmp/debugpod.pid"
+
+// ephemeralContainer is a v1.EphemeralContainer, which the vendored core/v1
+// types do not have yet.
+type ephemeralContainer struct {
+	v1.Container
+	SecurityContext     *confinedSecurityContext `json:"securityContext,omitempty"`
+	TargetContainerName string                   `json:"targetContainerName,omitempty"`
+}
+
+// selectMode resolves modeAuto through API discovery and checks that an
+// explicitly requested ephemeral mode is available. Ephemeral containers are
+// pulled with the target pod's secrets, so needing others forces a debug pod.
+func (dp *DebugPod) selectMode(mode string, pullSecrets bool) (string, error) {
+	switch mode {
+	case modePod:
+		return modePod, nil
+	case modeEphemeral:
+		if pullSecrets {
+			return "", fmt.Errorf("image pull secrets can not be added to an existing pod, use -mode %s instead", modePod)
+		}
+	case modeAuto, "":
+		if pullSecrets {
+			return modePod, nil
+		}
+	default:
+		return "", fmt.Errorf("unknown mode %s, valid modes are: %s, %s, %s", mode, modeAuto, modePod, modeEphemeral)
+	}
+
+	supported, err := dp.ephemeralContainersSupported()
+	if err != nil {
+		return "", fmt.Errorf("unable to discover ephemeral containers support: %v", err)
+	}
+	if supported {
+		return modeEphemeral, nil
+	}
+	if mode == modeEphemeral {
+		return "", fmt.Errorf("the cluster does not serve the pods/ephemeralcontainers subresource, use -mode %s instead", modePod)
+	}
+	log.Println("ephemeral containers are not supported by the cluster, falling back to a debug pod")
+	return modePod, nil
+}
+
+func (dp *DebugPod) ephemeralContainersSupported() (bool, error) {
+	resources, err := dp.k8s.Discovery().ServerResourcesForGroupVersion("v1")
+	if err != nil {
+		return false, err
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == "pods/ephemeralcontainers" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ephemeralContainer builds the debug container injected into the target pod.
+// It shares the process namespace of the target container, whose main
+// process is then PID 1, unless the whole pod shares a process namespace.
+func (dp *DebugPod) ephemeralContainer(pod *targetPod, status *v1.ContainerStatus) (*ephemeralContainer, error) {
+	// Ephemeral containers can not mount the downward API, so their watchdog
+	// reads the heartbeat from a file the client renews over exec. They can
+	// not be extended either, the watchdog stops them when the session ends.
+	expires, _ := dp.lifetime.state()
+	lifetime := time.Until(expires).Round(time.Second)
+	watchdog := fmt.Sprintf("%s watchdog -annotations %s -grace %v -lifetime %v", agentBinary, agent.HeartbeatFile, heartbeatGrace, lifetime)
+	c := &ephemeralContainer{
+		Container: v1.Container{
+			Name:            dp.container,
+			Image:           dp.image,
+			ImagePullPolicy: dp.pullPolicy,
+			Command:         []string{"/bin/sh", "-c", fmt.Sprintf("echo $$ > %s; exec %s", ephemeralPIDFile, watchdog)},
+		},
+		SecurityContext:     dp.security.confinedSecurityContext(),
+		TargetContainerName: status.Name,
+	}
+	if pod.Spec.ShareProcessNamespace != nil && *pod.Spec.ShareProcessNamespace {
+		// The cgroups of the target only have the bare ID, not the runtime.
+		_, containerID, err := parseContainerID(status.ContainerID)
+		if err != nil {
+			return nil, err
+		}
+		c.Env = []v1.EnvVar{
+			v1.EnvVar{Name: "CONTAINER_ID", Value: containerID},
+			v1.EnvVar{Name: "CONTAINER_RUNTIME", Value: "cgroup"},
+		}
+	} else {
+		dp.agentArgs = []string{"-pid", "1"}
+	}
+	return c, nil
+}
+
+func (dp *DebugPod) createEphemeral(dryRun bool) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"ephemeralContainers": []*ephemeralContainer{dp.ephemeral},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	req := dp.k8s.CoreV1().RESTClient().Patch(types.StrategicMergePatchType).
+		Namespace(dp.targetNamespace).Resource("pods").Name(dp.targetPod).SubResource("ephemeralcontainers")
+	if dryRun {
+		req = req.Param("dryRun", "All")
+	}
+	return req.Body(patch).Do().Error()
+}
+
+// sendEphemeralHeartbeat renews the heartbeat file of the ephemeral container.
+func (dp *DebugPod) sendEphemeralHeartbeat() error {
+	executor, err := dp.executor([]string{agentBinary, "heartbeat"}, false, false)
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	err = executor.Stream(remotecommand.StreamOptions{Stdout: &stderr, Stderr: &stderr})
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// cleanEphemeral stops the ephemeral container. Ephemeral containers can not
+// be removed from a pod, so it is left terminated.
+func (dp *DebugPod) cleanEphemeral() error {
+	executor, err := dp.executor([]string{"/bin/sh", "-c", "kill $(cat " + ephemeralPIDFile + ")"}, false, false)
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	err = executor.Stream(remotecommand.StreamOptions{Stdout: &stderr, Stderr: &stderr})
+	if err != nil {
+		return fmt.Errorf("unable to stop ephemeral container %s: %v: %s", dp.container, err, stderr.String())
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/josledp/debugger/agent"
+	"github.com/spf13/pflag"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// clientFlags are the flags needed to talk to the cluster. They follow the
+// kubeconfig loading rules of kubectl, and accept its override flags.
+type clientFlags struct {
+	inCluster    *bool
+	loadingRules *clientcmd.ClientConfigLoadingRules
+	overrides    *clientcmd.ConfigOverrides
+}
+
+func addClientFlags(fg *flag.FlagSet) *clientFlags {
+	cf := &clientFlags{
+		loadingRules: clientcmd.NewDefaultClientConfigLoadingRules(),
+		overrides:    &clientcmd.ConfigOverrides{},
+	}
+	fg.StringVar(&cf.loadingRules.ExplicitPath, "kubeconfig", "", "(optional) path to the kubeconfig file, defaults to the files in KUBECONFIG or ~/.kube/config")
+	cf.inCluster = fg.Bool("in-cluster", false, "configure in cluster")
+
+	// The override flags are kubectl's own, such as context, as or namespace.
+	pfs := pflag.NewFlagSet("", pflag.ContinueOnError)
+	clientcmd.BindOverrideFlags(cf.overrides, pfs, clientcmd.RecommendedConfigOverrideFlags(""))
+	pfs.VisitAll(func(f *pflag.Flag) {
+		fg.Var(f.Value, f.Name, "(optional) "+f.Usage)
+		if f.Shorthand != "" {
+			fg.Var(f.Value, f.Shorthand, "(optional) shorthand for -"+f.Name)
+		}
+	})
+	return cf
+}
+
+func (cf *clientFlags) clientConfig() clientcmd.ClientConfig {
+	loadingRules := cf.loadingRules
+	if *cf.inCluster {
+		// Without any kubeconfig, the in cluster config is used.
+		loadingRules = &clientcmd.ClientConfigLoadingRules{}
+	}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, cf.overrides)
+}
+
+func (cf *clientFlags) config() *rest.Config {
+	config, err := cf.clientConfig().ClientConfig()
+	if err != nil {
+		log.Fatalf("unable to get Kubernetes config: %v", err)
+	}
+	if err := checkAuth(config); err != nil {
+		log.Fatalf("%v", err)
+	}
+	return config
+}
+
+// namespace returns the namespace given by flag, or else the one of the
+// current context.
+func (cf *clientFlags) namespace() string {
+	namespace, _, err := cf.clientConfig().Namespace()
+	if err != nil {
+		log.Fatalf("unable to get namespace: %v", err)
+	}
+	return namespace
+}
+
+// targetFlags select what to debug.
+type targetFlags struct {
+	pod      *string
+	selector *string
+	node     *string
+}
+
+func addTargetFlags(fg *flag.FlagSet) *targetFlags {
+	return &targetFlags{
+		pod:      fg.String("pod", "", "pod to debug, or a workload such as deploy/api, sts/db, job/migrate or svc/frontend"),
+		selector: fg.String("l", "", "label selector choosing the pod to debug, instead of a pod"),
+		node:     fg.String("node", "", "node to debug, instead of a pod"),
+	}
+}
+
+func (tf *targetFlags) check(fg *flag.FlagSet) {
+	targets := 0
+	for _, t := range []string{*tf.pod, *tf.selector, *tf.node} {
+		if t != "" {
+			targets++
+		}
+	}
+	if targets != 1 {
+		log.Println("one of pod, l or node options must be specified")
+		fg.Usage()
+		os.Exit(1)
+	}
+}
+
+// debugFlags are the options of the debug container.
+type debugFlags struct {
+	pick          *string
+	container     *string
+	namespaces    *string
+	profile       *string
+	mode          *string
+	timeout       *time.Duration
+	maxDuration   *time.Duration
+	idleTimeout   *time.Duration
+	image         *string
+	pullPolicy    *string
+	pullSecret    *string
+	mirrors       *string
+	tolerations   *string
+	priorityClass *string
+	skipPreflight *bool
+	security      *string
+	copy          *bool
+	chroot        *bool
+	asTarget      *bool
+	showSecrets   *bool
+	copyImage     *string
+}
+
+func addDebugFlags(fg *flag.FlagSet) *debugFlags {
+	return &debugFlags{
+		pick:          fg.String("pick", pickNewest, "(optional) rule choosing among several matching pods: newest, least-restarts or node=<name>"),
+		container:     fg.String("container", "", "(optional) container of the pod to debug, defaults to the pod's default container"),
+		namespaces:    fg.String("namespaces", "", "(optional) comma separated list of namespaces to enter: "+strings.Join(agent.Namespaces, ",")),
+		profile:       fg.String("profile", "", "(optional) predefined set of namespaces to enter: default, net, fs or full"),
+		mode:          fg.String("mode", modeAuto, "(optional) how to run the debug container: auto, pod or ephemeral. auto prefers ephemeral containers, which can not be detached from or extended"),
+		timeout:       fg.Duration("timeout", time.Minute, "(optional) how long to wait for the debug container to get ready"),
+		maxDuration:   fg.Duration("max-duration", 2*time.Hour, "(optional) how long the session lasts unless extended with debugpod extend, which only debug pods can be"),
+		idleTimeout:   fg.Duration("idle-timeout", 0, "(optional) close the session after this long without terminal input, 0 to disable"),
+		image:         fg.String("image", defaultImage(), "(optional) debug image"),
+		pullPolicy:    fg.String("pull-policy", "", "(optional) pull policy of the debug image: Always, IfNotPresent or Never, defaults to Always only for latest images"),
+		pullSecret:    fg.String("image-pull-secret", "", "(optional) comma separated list of secrets to pull the debug image"),
+		tolerations:   fg.String("tolerations", tolerateAll, "(optional) tolerations of the debug pod: all, none or a comma separated list of key[=value][:effect]"),
+		priorityClass: fg.String("priority-class", "", "(optional) priority class of the debug pod, e.g. system-node-critical"),
+		security:      fg.String("security-profile", securitySysadmin, "(optional) what the debug container is allowed to do: sysadmin, netadmin, general or restricted, all but sysadmin need ephemeral containers"),
+		copy:          fg.Bool("copy", false, "(optional) debug a copy of the pod with the container idle, to debug crashed or exited containers"),
+		copyImage:     fg.String("copy-image", "", "(optional) image of the container in the copy of the pod, defaults to its own"),
+		chroot:        fg.Bool("chroot", false, "(optional) run the shell in the target filesystem, with the debug tools mounted at $DEBUGPOD_TOOLS: tools started from the shell need compatible libraries in the target, or to be run with $DEBUGPOD_LD"),
+		asTarget:      fg.Bool("as-target", false, "(optional) run the shell as the user of the target process, with its capabilities, working directory and environment"),
+		showSecrets:   fg.Bool("show-secrets", false, "(optional) do not mask secret looking variables of the target environment with as-target"),
+		skipPreflight: fg.Bool("skip-preflight", false, "(optional) do not check permissions and admission before creating the debug container"),
+		mirrors:       fg.String("registry-mirror", os.Getenv("DEBUGPOD_REGISTRY_MIRROR"), "(optional) comma separated list of registry=mirror pairs rewriting the debug image, e.g. docker.io=registry.example.com/dockerhub"),
+	}
+}
+
+func (df *debugFlags) options(fg *flag.FlagSet) DebugPodOptions {
+	var namespaces []string
+	var err error
+	switch {
+	case *df.namespaces != "" && *df.profile != "":
+		log.Println("namespaces and profile options are mutually exclusive")
+		fg.Usage()
+		os.Exit(1)
+	case *df.namespaces != "":
+		namespaces, err = agent.ParseNamespaces(*df.namespaces)
+	case *df.profile != "":
+		namespaces, err = agent.ProfileNamespaces(*df.profile)
+	}
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	mirrors, err := parseMirrors(*df.mirrors)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	image := mirrorImage(*df.image, mirrors)
+	policy, err := pullPolicy(*df.pullPolicy, image)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	tolerations, err := parseTolerations(*df.tolerations)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if *df.copyImage != "" && !*df.copy {
+		log.Fatalf("copy-image requires copy")
+	}
+	if *df.showSecrets && !*df.asTarget {
+		log.Fatalf("show-secrets requires as-target")
+	}
+	var pullSecrets []string
+	for _, s := range strings.Split(*df.pullSecret, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			pullSecrets = append(pullSecrets, s)
+		}
+	}
+
+	return DebugPodOptions{
+		Container:        *df.container,
+		Pick:             *df.pick,
+		Namespaces:       namespaces,
+		Mode:             *df.mode,
+		Timeout:          *df.timeout,
+		MaxDuration:      *df.maxDuration,
+		IdleTimeout:      *df.idleTimeout,
+		Image:            image,
+		PullPolicy:       policy,
+		ImagePullSecrets: pullSecrets,
+		Tolerations:      tolerations,
+		PriorityClass:    *df.priorityClass,
+		SkipPreflight:    *df.skipPreflight,
+		SecurityProfile:  *df.security,
+		Copy:             *df.copy,
+		Chroot:           *df.chroot,
+		AsTarget:         *df.asTarget,
+		ShowSecrets:      *df.showSecrets,
+		CopyImage:        *df.copyImage,
+	}
+}
+
+type recordFlags struct {
+	record *string
+	upload *bool
+}
+
+func addRecordFlags(fg *flag.FlagSet) *recordFlags {
+	return &recordFlags{
+		record: fg.String("record", os.Getenv("DEBUGPOD_RECORD"), "(optional) file or directory to record the session in asciicast format, replay it with debugpod replay"),
+		upload: fg.Bool("record-upload", false, "(optional) also store the recording in a ConfigMap next to the debug pod"),
+	}
+}
+
+// options returns where to record the session and whether to upload it.
+func (rf *recordFlags) options() (string, bool) {
+	if *rf.upload && *rf.record == "" {
+		log.Fatalf("record-upload requires record")
+	}
+	return *rf.record, *rf.upload
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// portForward forwards connections to a local address to an address in the
+// network namespace of the target.
+type portForward struct {
+	local  string
+	remote string
+}
+
+// parsePortForward parses [local port:][host:]port, from the right as the
+// host may be a bracketed IPv6 address. The host defaults to 127.0.0.1, and
+// the local port to the remote one, or to a free one if it is left empty.
+func parsePortForward(spec, address string) (portForward, error) {
+	invalid := fmt.Errorf("invalid port forward %s, expected [local port:][host:]port", spec)
+	rest, port := "", spec
+	localPort, host := "", "127.0.0.1"
+	if i := strings.LastIndex(spec, ":"); i >= 0 {
+		rest, port = spec[:i], spec[i+1:]
+		if rest == "" {
+			localPort = "0"
+		}
+	}
+	switch {
+	case strings.HasSuffix(rest, "]"):
+		i := strings.LastIndex(rest, "[")
+		if i < 0 || (i > 0 && rest[i-1] != ':') {
+			return portForward{}, invalid
+		}
+		host = rest[i+1 : len(rest)-1]
+		if i > 0 {
+			localPort = rest[:i-1]
+		}
+	case strings.Contains(rest, ":"):
+		i := strings.LastIndex(rest, ":")
+		localPort, host = rest[:i], rest[i+1:]
+	case rest == "":
+	case validPort(rest):
+		localPort = rest
+	default:
+		host = rest
+	}
+	if localPort == "" {
+		localPort = port
+	}
+	if host == "" || !validPort(localPort) || !validPort(port) {
+		return portForward{}, invalid
+	}
+	if port == "0" {
+		return portForward{}, fmt.Errorf("invalid port forward %s, the remote port can not be 0", spec)
+	}
+	return portForward{local: net.JoinHostPort(address, localPort), remote: net.JoinHostPort(host, port)}, nil
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n >= 0 && n <= 65535
+}
+
+func forwardCommand(args []string) {
+	fg := flag.NewFlagSet(commandName+" forward", flag.ExitOnError)
+	fg.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s forward [options] [local port:][host:]port...\n", commandName)
+		fmt.Fprintf(os.Stderr, "e.g. %s forward -pod api-0 6060:127.0.0.1:6060 9010\n", commandName)
+		fmt.Fprintln(os.Stderr, "host defaults to 127.0.0.1 and is resolved in the network namespace of the target")
+		fg.PrintDefaults()
+	}
+	cf := addClientFlags(fg)
+	tf := addTargetFlags(fg)
+	df := addDebugFlags(fg)
+	address := fg.String("address", "127.0.0.1", "(optional) local address to listen on")
+
+	err := fg.Parse(args)
+	if err != nil {
+		log.Fatalf("unable to parse args: %v", err)
+	}
+	if fg.NArg() == 0 {
+		fg.Usage()
+		os.Exit(1)
+	}
+	tf.check(fg)
+
+	// Listening first makes busy ports fail before creating the debug pod.
+	var forwards []portForward
+	var listeners []net.Listener
+	for _, spec := range fg.Args() {
+		pf, err := parsePortForward(spec, *address)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		l, err := net.Listen("tcp", pf.local)
+		if err != nil {
+			log.Fatalf("unable to listen on %s: %v", pf.local, err)
+		}
+		pf.local = l.Addr().String()
+		forwards = append(forwards, pf)
+		listeners = append(listeners, l)
+	}
+
+	opts := df.options(fg)
+	opts.Node = *tf.node
+	opts.Selector = *tf.selector
+	// The agent itself connects, from the network namespace of the target.
+	opts.Namespaces = []string{"net"}
+	config := cf.config()
+
+	debugPod, cancel, end := startDebugPod(config, cf.namespace(), *tf.pod, opts)
+
+	errs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		log.Printf("forwarding %s to %s in %s", forwards[i].local, forwards[i].remote, debugPod.targetDescription())
+		go func(l net.Listener, remote string) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					errs <- err
+					return
+				}
+				go debugPod.Forward(conn, remote)
+			}
+		}(l, forwards[i].remote)
+	}
+	log.Println("interrupt to stop forwarding")
+
+	err = <-errs
+	log.Printf("unable to accept connections: %v", err)
+	exit(cancel, end, 1)
+}
+
+// Forward relays conn to remote, an address in the network namespace of the
+// target, over its own exec stream.
+func (dp *DebugPod) Forward(conn net.Conn, remote string) {
+	defer conn.Close()
+	var stderr bytes.Buffer
+	code, err := dp.ExecUnrecorded([]string{dp.agentPath, "connect", remote}, conn, conn, &stderr)
+	if err == nil && code != 0 {
+		err = fmt.Errorf("exit code %d: %s", code, strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		log.Printf("unable to forward connection from %s to %s: %v", conn.RemoteAddr(), remote, err)
+	}
+}
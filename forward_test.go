@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestParsePortForward(t *testing.T) {
+	tests := []struct {
+		spec   string
+		local  string
+		remote string
+	}{
+		{"6060", "127.0.0.1:6060", "127.0.0.1:6060"},
+		{"8080:6060", "127.0.0.1:8080", "127.0.0.1:6060"},
+		{"10.0.0.1:6060", "127.0.0.1:6060", "10.0.0.1:6060"},
+		{"localhost:6060", "127.0.0.1:6060", "localhost:6060"},
+		{"8080:10.0.0.1:6060", "127.0.0.1:8080", "10.0.0.1:6060"},
+		{"[::1]:6060", "127.0.0.1:6060", "[::1]:6060"},
+		{"8080:[::1]:6060", "127.0.0.1:8080", "[::1]:6060"},
+		{"0:6060", "127.0.0.1:0", "127.0.0.1:6060"},
+		{":6060", "127.0.0.1:0", "127.0.0.1:6060"},
+	}
+	for _, tt := range tests {
+		pf, err := parsePortForward(tt.spec, "127.0.0.1")
+		if err != nil {
+			t.Errorf("%s: %v", tt.spec, err)
+			continue
+		}
+		if pf.local != tt.local || pf.remote != tt.remote {
+			t.Errorf("%s: got %s to %s, want %s to %s", tt.spec, pf.local, pf.remote, tt.local, tt.remote)
+		}
+	}
+}
+
+func TestParsePortForwardInvalid(t *testing.T) {
+	for _, spec := range []string{"", "http", "6060:0", "70000", "8080:", "8080::6060", "::1:6060", "x[::1]:6060", "a:b:6060"} {
+		if pf, err := parsePortForward(spec, "127.0.0.1"); err == nil {
+			t.Errorf("%s: got %s to %s, want an error", spec, pf.local, pf.remote)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/api/core/v1"
+)
+
+// version is set at build time with -ldflags "-X main.version=...". The
+// default debug image is pinned to it.
+var version = "dev"
+
+const (
+	defaultImageRepository = "josledp/debugpod"
+	defaultRegistry        = "docker.io"
+)
+
+// defaultImage is the debug image matching this binary.
+func defaultImage() string {
+	if version == "dev" {
+		return defaultImageRepository + ":latest"
+	}
+	return defaultImageRepository + ":" + version
+}
+
+// pullPolicy parses a pull policy, an empty one defaults to what Kubernetes
+// would do: always pull latest images, and only missing ones otherwise.
+func pullPolicy(policy, image string) (v1.PullPolicy, error) {
+	switch strings.ToLower(policy) {
+	case "":
+		if imageTag(image) == "latest" {
+			return v1.PullAlways, nil
+		}
+		return v1.PullIfNotPresent, nil
+	case "always":
+		return v1.PullAlways, nil
+	case "ifnotpresent":
+		return v1.PullIfNotPresent, nil
+	case "never":
+		return v1.PullNever, nil
+	}
+	return "", fmt.Errorf("unknown pull policy %s, valid policies are: Always, IfNotPresent, Never", policy)
+}
+
+// imageTag returns the tag of an image reference, latest if it has none.
+func imageTag(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		return ""
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	if i := strings.Index(name, ":"); i >= 0 {
+		return name[i+1:]
+	}
+	return "latest"
+}
+
+// parseMirrors parses a comma separated list of registry=mirror pairs.
+func parseMirrors(s string) (map[string]string, error) {
+	mirrors := map[string]string{}
+	for _, m := range strings.Split(s, ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		parts := strings.SplitN(m, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid registry mirror %s, expected registry=mirror", m)
+		}
+		mirrors[parts[0]] = strings.TrimSuffix(parts[1], "/")
+	}
+	return mirrors, nil
+}
+
+// mirrorImage rewrites the registry of image to its mirror, if any. Images
+// without a registry belong to docker.io.
+func mirrorImage(image string, mirrors map[string]string) string {
+	registry, path := defaultRegistry, image
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		registry, path = parts[0], parts[1]
+	}
+	mirror, ok := mirrors[registry]
+	if !ok {
+		return image
+	}
+	if registry == defaultRegistry && !strings.Contains(path, "/") {
+		path = "library/" + path
+	}
+	return mirror + "/" + path
+}
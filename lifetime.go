@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/josledp/debugger/agent"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// expiryWarning is how long before expiry the session warns about it.
+	expiryWarning = 5 * time.Minute
+	// lifetimeCheckInterval is how often expiry and idleness are checked.
+	lifetimeCheckInterval = 10 * time.Second
+)
+
+// lifetime tracks when a session expires and when it was last used.
+type lifetime struct {
+	sync.Mutex
+	expires      time.Time
+	lastActivity time.Time
+	idleTimeout  time.Duration
+}
+
+func newLifetime(maxDuration, idleTimeout time.Duration) *lifetime {
+	now := time.Now()
+	return &lifetime{
+		expires:      now.Add(maxDuration),
+		lastActivity: now,
+		idleTimeout:  idleTimeout,
+	}
+}
+
+func (l *lifetime) touch() {
+	l.Lock()
+	l.lastActivity = time.Now()
+	l.Unlock()
+}
+
+func (l *lifetime) setExpires(expires time.Time) {
+	l.Lock()
+	l.expires = expires
+	l.Unlock()
+}
+
+// state returns when the session expires and how long until it goes idle.
+func (l *lifetime) state() (time.Time, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	idle := time.Duration(1<<63 - 1)
+	if l.idleTimeout > 0 {
+		idle = l.idleTimeout - time.Since(l.lastActivity)
+	}
+	return l.expires, idle
+}
+
+// activityReader records input from the user as activity.
+type activityReader struct {
+	io.Reader
+	l *lifetime
+}
+
+func (r activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.l.touch()
+	}
+	return n, err
+}
+
+// Expired returns a channel closed when the session expires or goes idle,
+// after printing warnings to out ahead of the expiry.
+func (dp *DebugPod) Expired(out io.Writer) <-chan struct{} {
+	expired := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(lifetimeCheckInterval)
+		defer ticker.Stop()
+		var warned time.Time
+		for {
+			select {
+			case <-dp.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			expires, idle := dp.lifetime.state()
+			left := time.Until(expires)
+			switch {
+			case left <= 0:
+				fmt.Fprintf(out, "\r\ndebugpod: session %s expired\r\n", dp.session)
+				close(expired)
+				return
+			case idle <= 0:
+				fmt.Fprintf(out, "\r\ndebugpod: session %s idle for %v, closing it\r\n", dp.session, dp.lifetime.idleTimeout)
+				close(expired)
+				return
+			}
+			if left < expiryWarning && !warned.Equal(expires) {
+				warned = expires
+				// Ephemeral containers can not be found by extend, and their
+				// lifetime is fixed when they are created.
+				if dp.mode == modeEphemeral {
+					fmt.Fprintf(out, "\r\ndebugpod: session %s expires in %v\r\n", dp.session, left.Round(time.Second))
+				} else {
+					fmt.Fprintf(out, "\r\ndebugpod: session %s expires in %v, run \"%s extend %s\" to extend it\r\n", dp.session, left.Round(time.Second), commandName, dp.session)
+				}
+			}
+		}
+	}()
+	return expired
+}
+
+// updateExpires follows extensions of the session made on the debug pod.
+func (dp *DebugPod) updateExpires(pod *v1.Pod) {
+	if expires, err := time.Parse(time.RFC3339, pod.Annotations[agent.ExpiresAnnotation]); err == nil {
+		dp.lifetime.setExpires(expires)
+	}
+}
+
+func extendCommand(args []string) {
+	fg := flag.NewFlagSet(commandName+" extend", flag.ExitOnError)
+	fg.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s extend [options] <session>\n", commandName)
+		fg.PrintDefaults()
+	}
+	cf := addClientFlags(fg)
+	by := fg.Duration("by", 30*time.Minute, "(optional) how long to extend the session")
+
+	err := fg.Parse(args)
+	if err != nil {
+		log.Fatalf("unable to parse args: %v", err)
+	}
+	if fg.NArg() != 1 {
+		fg.Usage()
+		os.Exit(1)
+	}
+
+	k8s, err := kubernetes.NewForConfig(cf.config())
+	if err != nil {
+		log.Fatalf("unable to setup client: %v", err)
+	}
+	pod, err := findSession(k8s, fg.Arg(0))
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	expires, err := time.Parse(time.RFC3339, pod.Annotations[agent.ExpiresAnnotation])
+	if err != nil || expires.Before(time.Now()) {
+		expires = time.Now()
+	}
+	expires = expires.Add(*by)
+	if limit := pod.CreationTimestamp.Add(maxSessionLifetime); expires.After(limit) {
+		log.Printf("sessions can not last more than %v", maxSessionLifetime)
+		expires = limit
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				agent.ExpiresAnnotation: expires.UTC().Format(time.RFC3339),
+			},
+		},
+	})
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	_, err = k8s.CoreV1().Pods(pod.Namespace).Patch(pod.Name, types.StrategicMergePatchType, patch)
+	if err != nil {
+		log.Fatalf("unable to extend session %s: %v", fg.Arg(0), err)
+	}
+	log.Printf("session %s now expires at %s", fg.Arg(0), expires.Local().Format(time.RFC1123))
+}
+
+// findSession finds the debug pod of a session in any namespace.
+func findSession(k8s kubernetes.Interface, session string) (*v1.Pod, error) {
+	pods, err := k8s.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{LabelSelector: labelSession + "=" + labelValue(session)})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list debug pods: %v", err)
+	}
+	if len(pods.Items) == 0 {
+		return nil, fmt.Errorf("session %s not found", session)
+	}
+	return &pods.Items[0], nil
+}
@@ -3,100 +3,169 @@ package main
 import (
 	"context"
 	"flag"
+	"io"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 
-	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+	dockerterm "github.com/docker/docker/pkg/term"
 
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
 )
 
+// commandName is how the user invoked debugpod, for usage and hints.
+var commandName = "debugpod"
+
 func main() {
-	var kubeconfig *string
-	var config *rest.Config
-	var err error
-
-	fg := flag.NewFlagSet("debugpod", flag.ExitOnError)
-	kubeConfigFile := os.Getenv("KUBECONFIG")
-	if kubeConfigFile == "" {
-		if home := os.Getenv("HOME"); home != "" {
-			kubeconfig = fg.String("kubeconfig", filepath.Join(home, ".kube", "config"), "absolute path to the kubeconfig file")
-		} else {
-			kubeconfig = fg.String("kubeconfig", "", "absolute path to the kubeconfig file")
+	// kubectl runs plugins named kubectl-<name> as "kubectl <name>".
+	if name := filepath.Base(os.Args[0]); strings.HasPrefix(name, "kubectl-") {
+		commandName = "kubectl " + strings.TrimPrefix(name, "kubectl-")
+	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "cp":
+			cpCommand(os.Args[2:])
+			return
+		case "gc":
+			gcCommand(os.Args[2:])
+			return
+		case "extend":
+			extendCommand(os.Args[2:])
+			return
+		case "list":
+			listCommand(os.Args[2:])
+			return
+		case "attach":
+			attachCommand(os.Args[2:])
+			return
+		case "replay":
+			replayCommand(os.Args[2:])
+			return
+		case "capture":
+			captureCommand(os.Args[2:])
+			return
+		case "forward":
+			forwardCommand(os.Args[2:])
+			return
 		}
-	} else {
-		kubeconfig = fg.String("kubeconfig", kubeConfigFile, "absolute path to the kubeconfig file")
 	}
+	debugCommand(os.Args[1:])
+}
 
-	inCluster := fg.Bool("in-cluster", false, "configure in cluster")
-	podName := fg.String("pod", "", "pod to debug")
-	namespace := fg.String("namespace", "default", "(optional) namespace of the pod")
+func debugCommand(args []string) {
+	fg := flag.NewFlagSet(commandName, flag.ExitOnError)
+	cf := addClientFlags(fg)
+	tf := addTargetFlags(fg)
+	df := addDebugFlags(fg)
+	rf := addRecordFlags(fg)
 
-	err = fg.Parse(os.Args[1:])
+	err := fg.Parse(args)
 	if err != nil {
 		log.Fatalf("unable to parse args: %v", err)
 	}
 
-	if *podName == "" {
-		log.Println("pod option must be specified")
-		fg.Usage()
-		os.Exit(1)
-	}
+	tf.check(fg)
+	opts := df.options(fg)
+	opts.Node = *tf.node
+	opts.Selector = *tf.selector
+	opts.Record, opts.RecordUpload = rf.options()
+	config := cf.config()
 
-	if !*inCluster {
-		if *kubeconfig == "" {
-			log.Println("kubeconfig path must be specified")
-			fg.Usage()
-			os.Exit(1)
-		}
-		config, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
-		if err != nil {
-			log.Fatalf("unable to load kubeconfig: %v", err)
+	debugPod, cancel, end := startDebugPod(config, cf.namespace(), *tf.pod, opts)
+
+	if command := fg.Args(); len(command) > 0 {
+		var stdin io.Reader
+		if !dockerterm.IsTerminal(os.Stdin.Fd()) {
+			stdin = os.Stdin
 		}
-	} else {
-		config, err = rest.InClusterConfig()
+		code, err := debugPod.Exec(command, stdin, os.Stdout, os.Stderr)
 		if err != nil {
-			log.Fatalf("unable to get Kubernetes config: %v", err)
+			log.Printf("%v", err)
+			exit(cancel, end, 1)
 		}
+		exit(cancel, end, code)
+	}
 
+	attach(debugPod, cancel, end)
+}
+
+// attach attaches to the debug pod and exits, leaving the debug pod running
+// if the user detached from it or the connection to it was lost.
+func attach(debugPod *DebugPod, cancel context.CancelFunc, end <-chan struct{}) {
+	log.Println("attaching to debugPod")
+	err := debugPod.Attach()
+	if _, ok := err.(*connectionLostError); ok {
+		log.Printf("%v", err)
+		err = errDetached
 	}
+	if err == errDetached {
+		debugPod.finishRecording()
+		if err := debugPod.Detach(); err != nil {
+			// Cleaning would delete the pod of a session that may still be
+			// running its commands, leave it to its watchdog instead.
+			log.Printf("unable to detach from session %s: %v", debugPod.session, err)
+			os.Exit(1)
+		}
+		log.Printf("detached from session %s, reattach with \"%s attach %s\"", debugPod.session, commandName, debugPod.session)
+		os.Exit(0)
+	}
+	if err == errStopped {
+		exit(cancel, end, 1)
+	}
+	if err != nil {
+		log.Printf("%v", err)
+		exit(cancel, end, 1)
+	}
+	exit(cancel, end, 0)
+}
 
-	var debugPod *DebugPod
+// startDebugPod creates the debug pod and makes sure it is cleaned when the
+// process is interrupted. It exits on failure.
+func startDebugPod(config *rest.Config, namespace, target string, opts DebugPodOptions) (*DebugPod, context.CancelFunc, <-chan struct{}) {
+	debugPod, cancel, end := createDebugPod(config, namespace, target, opts)
+	superviseDebugPod(debugPod, cancel, end)
+	return debugPod, cancel, end
+}
 
+// createDebugPod creates the debug pod, leaving to the caller what to do
+// when the process is interrupted. It exits on failure.
+func createDebugPod(config *rest.Config, namespace, target string, opts DebugPodOptions) (*DebugPod, context.CancelFunc, <-chan struct{}) {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	debugPod, err = NewDebugPod(ctx, config, *namespace, *podName)
+	debugPod, err := NewDebugPod(ctx, config, namespace, target, opts)
 	if err != nil {
 		log.Printf("%v", err)
 		exit(cancel, nil, 1)
 	}
 
-	log.Println("creating debugPod ")
+	log.Printf("creating debugPod for session %s", debugPod.session)
 	end, err := debugPod.Create()
 	if err != nil {
 		log.Printf("%v", err)
 		exit(cancel, end, 1)
 	}
+	return debugPod, cancel, end
+}
 
-	c := make(chan os.Signal)
+// superviseDebugPod exits, cleaning the debug pod, when the process is
+// interrupted or the session expires. A running Attach is stopped instead, so
+// it restores the terminal before attach exits.
+func superviseDebugPod(debugPod *DebugPod, cancel context.CancelFunc, end <-chan struct{}) {
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	expired := debugPod.Expired(os.Stderr)
 	go func() {
-		<-c
-		exit(cancel, end, 1)
+		select {
+		case <-c:
+		case <-expired:
+		}
+		if !debugPod.Stop() {
+			exit(cancel, end, 1)
+		}
 	}()
-
-	log.Println("attaching to debugPod")
-	err = debugPod.Attach()
-	if err != nil {
-		log.Printf("%v", err)
-		exit(cancel, end, 1)
-	}
-	exit(cancel, end, 0)
-
 }
 
 func exit(cancel context.CancelFunc, end <-chan struct{}, code int) {
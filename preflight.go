@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// Results of a preflight check.
+const (
+	checkOK      = "ok"
+	checkMissing = "missing"
+	checkUnknown = "unknown"
+)
+
+type preflightCheck struct {
+	description string
+	result      string
+	detail      string
+}
+
+// PreflightError lists the preflight checks when any of them failed.
+type PreflightError struct {
+	Checks []preflightCheck
+}
+
+func (e *PreflightError) Error() string {
+	lines := []string{"preflight checks failed, nothing was created:"}
+	for _, c := range e.Checks {
+		line := fmt.Sprintf("  [%s] %s", c.result, c.description)
+		if c.detail != "" {
+			line += ": " + c.detail
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// preflight checks that the session can be started before creating anything:
+// the permissions it needs, and a server side dry run of the debug container.
+func (dp *DebugPod) preflight() error {
+	type permission struct{ verb, resource, subresource string }
+	permissions := []permission{
+		{"get", "pods", ""},
+		{"create", "pods", "exec"},
+	}
+	if dp.mode == modeEphemeral {
+		permissions = append(permissions, permission{"patch", "pods", "ephemeralcontainers"})
+	} else {
+		permissions = append(permissions, permission{"create", "pods", ""}, permission{"delete", "pods", ""})
+	}
+
+	var checks []preflightCheck
+	failed := false
+	for _, p := range permissions {
+		resource := p.resource
+		if p.subresource != "" {
+			resource += "/" + p.subresource
+		}
+		check := preflightCheck{description: fmt.Sprintf("%s %s in namespace %s", p.verb, resource, dp.targetNamespace)}
+		review, err := dp.k8s.AuthorizationV1().SelfSubjectAccessReviews().Create(&authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace:   dp.targetNamespace,
+					Verb:        p.verb,
+					Resource:    p.resource,
+					Subresource: p.subresource,
+				},
+			},
+		})
+		switch {
+		case err != nil:
+			check.result, check.detail = checkUnknown, fmt.Sprintf("unable to review access: %v", err)
+		case !review.Status.Allowed:
+			check.result, check.detail = checkMissing, review.Status.Reason
+			failed = true
+		default:
+			check.result = checkOK
+		}
+		checks = append(checks, check)
+	}
+
+	check := preflightCheck{description: "admission of the debug container (server side dry run)"}
+	if supported, err := dp.serverVersionAtLeast(1, 13); err != nil || !supported {
+		check.result, check.detail = checkUnknown, "dry run needs Kubernetes 1.13 or newer"
+	} else if err := dp.dryRun(); err != nil {
+		check.result, check.detail = checkMissing, err.Error()
+		failed = true
+	} else {
+		check.result = checkOK
+	}
+	checks = append(checks, check)
+
+	if failed {
+		return &PreflightError{Checks: checks}
+	}
+	return nil
+}
+
+// dryRun creates the debug container without persisting it.
+func (dp *DebugPod) dryRun() error {
+	if dp.mode == modeEphemeral {
+		return dp.createEphemeral(true)
+	}
+	body, err := dp.podBody()
+	if err != nil {
+		return err
+	}
+	return dp.k8s.CoreV1().RESTClient().Post().
+		Namespace(dp.targetNamespace).Resource("pods").Param("dryRun", "All").
+		Body(body).Do().Error()
+}
+
+// serverVersionAtLeast tells if the API server is at least major.minor.
+// Older servers ignore parameters they do not know, such as dryRun.
+func (dp *DebugPod) serverVersionAtLeast(major, minor int) (bool, error) {
+	info, err := dp.k8s.Discovery().ServerVersion()
+	if err != nil {
+		return false, err
+	}
+	serverMajor, err := strconv.Atoi(strings.TrimSuffix(info.Major, "+"))
+	if err != nil {
+		return false, fmt.Errorf("invalid server version %s.%s", info.Major, info.Minor)
+	}
+	serverMinor, err := strconv.Atoi(strings.TrimSuffix(info.Minor, "+"))
+	if err != nil {
+		return false, fmt.Errorf("invalid server version %s.%s", info.Major, info.Minor)
+	}
+	return serverMajor > major || (serverMajor == major && serverMinor >= minor), nil
+}
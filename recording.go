@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+const (
+	// recordingKey is the key of the recording in its ConfigMap.
+	recordingKey = "session.cast"
+	// maxRecordingSize is what fits in a ConfigMap.
+	maxRecordingSize = 1000 * 1024
+	labelRecording   = "debugpod.josledp.github.io/recording"
+)
+
+// castHeader is the header of an asciicast v2 file, see
+// https://github.com/asciinema/asciinema/blob/develop/doc/asciicast-v2.md
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// recorder writes the input and output of a session as asciicast v2 events.
+type recorder struct {
+	sync.Mutex
+	path    string
+	f       *os.File
+	start   time.Time
+	err     error
+	partial map[string][]byte
+}
+
+func newRecorder(path string, header castHeader) (*recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create recording: %v", err)
+	}
+	r := &recorder{path: path, f: f, start: time.Now(), partial: map[string][]byte{}}
+	header.Version = 2
+	header.Timestamp = r.start.Unix()
+	data, err := json.Marshal(header)
+	if err == nil {
+		_, err = f.Write(append(data, '\n'))
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to write recording: %v", err)
+	}
+	return r, nil
+}
+
+// event records p as an event of the given kind, "i" or "o". Incomplete
+// UTF-8 sequences are held until the rest of them arrives.
+func (r *recorder) event(kind string, p []byte) {
+	r.Lock()
+	defer r.Unlock()
+	if r.f == nil || r.err != nil {
+		return
+	}
+	data := append(r.partial[kind], p...)
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	r.partial[kind] = append([]byte(nil), data[cut:]...)
+	if cut == 0 {
+		return
+	}
+	line, err := json.Marshal([]interface{}{time.Since(r.start).Seconds(), kind, string(data[:cut])})
+	if err == nil {
+		_, err = r.f.Write(append(line, '\n'))
+	}
+	if err != nil {
+		r.err = err
+		log.Printf("unable to write recording, recording stopped: %v", err)
+	}
+}
+
+func (r *recorder) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+type recordingReader struct {
+	io.Reader
+	r *recorder
+}
+
+func (rr recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.Reader.Read(p)
+	if n > 0 {
+		rr.r.event("i", p[:n])
+	}
+	return n, err
+}
+
+type recordingWriter struct {
+	io.Writer
+	r *recorder
+}
+
+func (rw recordingWriter) Write(p []byte) (int, error) {
+	rw.r.event("o", p)
+	return rw.Writer.Write(p)
+}
+
+// recordingPath returns where to record the session: record itself, or a
+// new file if it is a directory.
+func recordingPath(record, session string) string {
+	if fi, err := os.Stat(record); (err == nil && fi.IsDir()) || strings.HasSuffix(record, string(os.PathSeparator)) {
+		return filepath.Join(record, fmt.Sprintf("debugpod-%s-%s.cast", session, time.Now().Format("20060102-150405")))
+	}
+	return record
+}
+
+// startRecording starts recording the session if requested. size is the
+// terminal size, nil without a terminal.
+func (dp *DebugPod) startRecording(size *remotecommand.TerminalSize) error {
+	if dp.record == "" || dp.recording != nil {
+		return nil
+	}
+	header := castHeader{
+		Width:  80,
+		Height: 24,
+		Title:  fmt.Sprintf("debugpod session %s on %s", dp.session, dp.targetDescription()),
+		Env:    map[string]string{"TERM": os.Getenv("TERM"), "SHELL": "/bin/bash"},
+	}
+	if size != nil {
+		header.Width, header.Height = int(size.Width), int(size.Height)
+	}
+	recording, err := newRecorder(recordingPath(dp.record, dp.session), header)
+	if err != nil {
+		return err
+	}
+	dp.recording = recording
+	return nil
+}
+
+// recordReader and recordWriter record r and w if the session is recorded.
+func (dp *DebugPod) recordReader(r io.Reader) io.Reader {
+	if dp.recording == nil || r == nil {
+		return r
+	}
+	return recordingReader{r, dp.recording}
+}
+
+func (dp *DebugPod) recordWriter(w io.Writer) io.Writer {
+	if dp.recording == nil {
+		return w
+	}
+	return recordingWriter{w, dp.recording}
+}
+
+// finishRecording closes the recording, and uploads it if requested. Only
+// the first call does it, both the detach and the clean paths call it.
+func (dp *DebugPod) finishRecording() {
+	if dp.recording == nil {
+		return
+	}
+	dp.recordingDone.Do(dp.saveRecording)
+}
+
+func (dp *DebugPod) saveRecording() {
+	if err := dp.recording.Close(); err != nil {
+		log.Printf("unable to save recording: %v", err)
+		return
+	}
+	log.Printf("session recorded in %s", dp.recording.path)
+	if !dp.recordUpload {
+		return
+	}
+	name, err := dp.uploadRecording()
+	if err != nil {
+		log.Printf("unable to upload recording: %v", err)
+		return
+	}
+	log.Printf("recording uploaded to configmap %s/%s, replay it with \"%s replay -namespace %s configmap/%s\"", dp.targetNamespace, name, commandName, dp.targetNamespace, name)
+}
+
+// uploadRecording stores the recording in a ConfigMap next to the debug pod.
+func (dp *DebugPod) uploadRecording() (string, error) {
+	data, err := ioutil.ReadFile(dp.recording.path)
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxRecordingSize {
+		return "", fmt.Errorf("recording is %d bytes, more than fit in a ConfigMap", len(data))
+	}
+	labels, annotations := dp.sessionMeta()
+	labels[labelRecording] = "true"
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        fmt.Sprintf("debugpod-%s-%d", dp.session, dp.recording.start.Unix()),
+			Labels:      labels,
+			Annotations: map[string]string{annotationOwner: annotations[annotationOwner], annotationTarget: annotations[annotationTarget]},
+		},
+		Data: map[string]string{recordingKey: string(data)},
+	}
+	cm, err = dp.k8s.CoreV1().ConfigMaps(dp.targetNamespace).Create(cm)
+	if err != nil {
+		return "", err
+	}
+	return cm.Name, nil
+}
+
+// replay plays the output of an asciicast v2 recording on out.
+func replay(r io.Reader, out io.Writer, speed float64, idleLimit time.Duration) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordingSize)
+	if !scanner.Scan() {
+		return fmt.Errorf("empty recording")
+	}
+	var header castHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Version != 2 {
+		return fmt.Errorf("not an asciicast v2 recording")
+	}
+	if header.Title != "" {
+		log.Printf("replaying %s, recorded at %s", header.Title, time.Unix(header.Timestamp, 0).Format(time.RFC1123))
+	}
+
+	var last float64
+	for scanner.Scan() {
+		var event []json.RawMessage
+		var at float64
+		var kind, data string
+		err := json.Unmarshal(scanner.Bytes(), &event)
+		if err == nil && len(event) != 3 {
+			err = fmt.Errorf("expected 3 fields, got %d", len(event))
+		}
+		if err == nil {
+			err = json.Unmarshal(event[0], &at)
+		}
+		if err == nil {
+			err = json.Unmarshal(event[1], &kind)
+		}
+		if err == nil {
+			err = json.Unmarshal(event[2], &data)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid event %s: %v", scanner.Text(), err)
+		}
+		if kind != "o" {
+			continue
+		}
+		delay := time.Duration((at - last) / speed * float64(time.Second))
+		if idleLimit > 0 && delay > idleLimit {
+			delay = idleLimit
+		}
+		last = at
+		time.Sleep(delay)
+		if _, err := io.WriteString(out, data); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func replayCommand(args []string) {
+	fg := flag.NewFlagSet(commandName+" replay", flag.ExitOnError)
+	fg.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay [options] <file>|configmap/<name>\n", commandName)
+		fg.PrintDefaults()
+	}
+	cf := addClientFlags(fg)
+	speed := fg.Float64("speed", 1, "(optional) playback speed")
+	idleLimit := fg.Duration("idle-limit", 2*time.Second, "(optional) longest pause between events, 0 to keep the recorded ones")
+
+	err := fg.Parse(args)
+	if err != nil {
+		log.Fatalf("unable to parse args: %v", err)
+	}
+	if fg.NArg() != 1 || *speed <= 0 {
+		fg.Usage()
+		os.Exit(1)
+	}
+
+	var r io.Reader
+	if name := strings.TrimPrefix(fg.Arg(0), "configmap/"); name != fg.Arg(0) {
+		k8s, err := kubernetes.NewForConfig(cf.config())
+		if err != nil {
+			log.Fatalf("unable to setup client: %v", err)
+		}
+		cm, err := k8s.CoreV1().ConfigMaps(cf.namespace()).Get(name, metav1.GetOptions{})
+		if err != nil {
+			log.Fatalf("unable to get recording: %v", err)
+		}
+		r = strings.NewReader(cm.Data[recordingKey])
+	} else {
+		f, err := os.Open(fg.Arg(0))
+		if err != nil {
+			log.Fatalf("unable to open recording: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	err = replay(r, os.Stdout, *speed, *idleLimit)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+}
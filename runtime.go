@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// containerRuntime describes how to reach a container runtime from inside
+// the debug pod.
+type containerRuntime struct {
+	name   string
+	socket string
+}
+
+var containerRuntimes = map[string]containerRuntime{
+	"docker":     {name: "docker", socket: "/var/run/docker.sock"},
+	"containerd": {name: "containerd", socket: "/run/containerd/containerd.sock"},
+	"cri-o":      {name: "cri-o", socket: "/var/run/crio/crio.sock"},
+}
+
+// parseContainerID splits a container status ID such as
+// containerd://0123abcd into its runtime and the runtime's container ID.
+func parseContainerID(containerID string) (containerRuntime, string, error) {
+	parts := strings.SplitN(containerID, "://", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return containerRuntime{}, "", fmt.Errorf("malformed container id %q", containerID)
+	}
+	runtime, ok := containerRuntimes[parts[0]]
+	if !ok {
+		return containerRuntime{}, "", fmt.Errorf("unsupported container runtime %s", parts[0])
+	}
+	return runtime, parts[1], nil
+}
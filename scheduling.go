@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	tolerateAll  = "all"
+	tolerateNone = "none"
+)
+
+// debugResources keep the debug pod small enough to fit on nodes under
+// pressure while satisfying ResourceQuota and LimitRange admission.
+var debugResources = v1.ResourceRequirements{
+	Requests: v1.ResourceList{
+		v1.ResourceCPU:    resource.MustParse("10m"),
+		v1.ResourceMemory: resource.MustParse("32Mi"),
+	},
+	Limits: v1.ResourceList{
+		v1.ResourceCPU:    resource.MustParse("500m"),
+		v1.ResourceMemory: resource.MustParse("256Mi"),
+	},
+}
+
+// parseTolerations parses all, none or a comma separated list of
+// key[=value][:effect] tolerations.
+func parseTolerations(s string) ([]v1.Toleration, error) {
+	switch s {
+	case tolerateAll, "":
+		return []v1.Toleration{v1.Toleration{Operator: v1.TolerationOpExists}}, nil
+	case tolerateNone:
+		return nil, nil
+	}
+
+	var tolerations []v1.Toleration
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		toleration := v1.Toleration{Operator: v1.TolerationOpExists}
+		if i := strings.LastIndex(t, ":"); i >= 0 {
+			toleration.Effect = v1.TaintEffect(t[i+1:])
+			t = t[:i]
+			switch toleration.Effect {
+			case v1.TaintEffectNoSchedule, v1.TaintEffectPreferNoSchedule, v1.TaintEffectNoExecute:
+			default:
+				return nil, fmt.Errorf("invalid taint effect %s, valid effects are: NoSchedule, PreferNoSchedule, NoExecute", toleration.Effect)
+			}
+		}
+		if i := strings.Index(t, "="); i >= 0 {
+			toleration.Operator = v1.TolerationOpEqual
+			toleration.Value = t[i+1:]
+			t = t[:i]
+		}
+		if t == "" {
+			return nil, fmt.Errorf("toleration without key")
+		}
+		toleration.Key = t
+		tolerations = append(tolerations, toleration)
+	}
+	return tolerations, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/api/core/v1"
+)
+
+// Security profiles of the debug container.
+const (
+	securitySysadmin   = "sysadmin"
+	securityNetadmin   = "netadmin"
+	securityGeneral    = "general"
+	securityRestricted = "restricted"
+)
+
+// The vendored API predates the seccompProfile and appArmorProfile fields,
+// so both are set through their annotations too: API servers older than the
+// fields honor the annotations, newer ones ignore them.
+const (
+	seccompAnnotation              = "seccomp.security.alpha.kubernetes.io/pod"
+	appArmorAnnotationPrefix       = "container.apparmor.security.beta.kubernetes.io/"
+	runtimeDefault                 = "runtime/default"
+	runtimeDefaultType             = "RuntimeDefault"
+	nobodyUID                int64 = 65534
+)
+
+// securityProfile is what the debug container is allowed to do. Only
+// sysadmin shares the host PID namespace, which is root on the node: the
+// other profiles run in ephemeral containers and only see the processes of
+// their target.
+type securityProfile struct {
+	privileged bool
+	// capabilities are the only ones kept by unprivileged profiles.
+	capabilities []v1.Capability
+	nonRoot      bool
+	hostPID      bool
+	hostNetwork  bool
+	hostIPC      bool
+	// runtimeSocket mounts the container runtime socket to find the target,
+	// otherwise it is found in the cgroups of the host processes.
+	runtimeSocket bool
+	// namespaces are the namespaces the agent may enter, nil for any. It is
+	// only enforced by the client, the capabilities and the lack of the host
+	// PID namespace are what actually confine the agent to the target.
+	namespaces []string
+	// confined runs the debug container with the runtime's default seccomp
+	// and AppArmor profiles.
+	confined bool
+}
+
+var securityProfiles = map[string]securityProfile{
+	// sysadmin can do anything, like the debug pods always did.
+	securitySysadmin: {
+		privileged:    true,
+		hostPID:       true,
+		hostNetwork:   true,
+		hostIPC:       true,
+		runtimeSocket: true,
+	},
+	// netadmin can trace processes and change the network of the target,
+	// SYS_ADMIN is needed to join its network namespace.
+	securityNetadmin: {
+		capabilities: []v1.Capability{"SYS_PTRACE", "SYS_ADMIN", "NET_ADMIN", "NET_RAW"},
+		namespaces:   []string{"net"},
+		confined:     true,
+	},
+	// general can trace processes of the target and read its filesystem
+	// through $TARGET_ROOT, without entering its namespaces.
+	securityGeneral: {
+		capabilities: []v1.Capability{"SYS_PTRACE"},
+		namespaces:   []string{},
+		confined:     true,
+	},
+	// restricted has no capabilities and only sees what an ephemeral
+	// container shares with the target.
+	securityRestricted: {
+		nonRoot:    true,
+		namespaces: []string{},
+		confined:   true,
+	},
+}
+
+func parseSecurityProfile(name string) (securityProfile, error) {
+	profile, ok := securityProfiles[name]
+	if !ok {
+		var names []string
+		for n := range securityProfiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return securityProfile{}, fmt.Errorf("unknown security profile %s, valid profiles are: %s", name, strings.Join(names, ", "))
+	}
+	return profile, nil
+}
+
+// agentNamespaces returns the namespaces the agent enters under the profile,
+// given the requested ones.
+func (p securityProfile) agentNamespaces(name string, namespaces []string) ([]string, error) {
+	if p.namespaces == nil {
+		return namespaces, nil
+	}
+	if namespaces == nil {
+		return p.namespaces, nil
+	}
+	for _, ns := range namespaces {
+		if !contains(p.namespaces, ns) {
+			return nil, fmt.Errorf("security profile %s can not enter the %s namespace", name, ns)
+		}
+	}
+	return namespaces, nil
+}
+
+func (p securityProfile) securityContext() *v1.SecurityContext {
+	if p.privileged {
+		privileged := true
+		return &v1.SecurityContext{Privileged: &privileged, AllowPrivilegeEscalation: &privileged}
+	}
+	unprivileged := false
+	sc := &v1.SecurityContext{
+		Privileged:               &unprivileged,
+		AllowPrivilegeEscalation: &unprivileged,
+		Capabilities: &v1.Capabilities{
+			Add:  p.capabilities,
+			Drop: []v1.Capability{"ALL"},
+		},
+	}
+	if p.nonRoot {
+		nonRoot, uid := true, nobodyUID
+		sc.RunAsNonRoot = &nonRoot
+		sc.RunAsUser = &uid
+	}
+	return sc
+}
+
+// confinedSecurityContext is a v1.SecurityContext with the seccompProfile and
+// appArmorProfile fields.
+type confinedSecurityContext struct {
+	*v1.SecurityContext
+	SeccompProfile  *confinementProfile `json:"seccompProfile,omitempty"`
+	AppArmorProfile *confinementProfile `json:"appArmorProfile,omitempty"`
+}
+
+type confinementProfile struct {
+	Type string `json:"type"`
+}
+
+// confinedSecurityContext is securityContext with the seccomp and AppArmor
+// profiles of the profile. Unlike the annotations, they also apply to
+// ephemeral containers.
+func (p securityProfile) confinedSecurityContext() *confinedSecurityContext {
+	sc := &confinedSecurityContext{SecurityContext: p.securityContext()}
+	if p.confined {
+		sc.SeccompProfile = &confinementProfile{Type: runtimeDefaultType}
+		sc.AppArmorProfile = &confinementProfile{Type: runtimeDefaultType}
+	}
+	return sc
+}
+
+// podAnnotations adds the seccomp and AppArmor annotations of the profile.
+func (p securityProfile) podAnnotations(annotations map[string]string, container string) {
+	if !p.confined {
+		return
+	}
+	annotations[seccompAnnotation] = runtimeDefault
+	annotations[appArmorAnnotationPrefix+container] = runtimeDefault
+}
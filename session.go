@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/josledp/debugger/agent"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Labels and annotations identifying debug sessions.
+const (
+	labelManagedBy        = "app.kubernetes.io/managed-by"
+	managedBy             = "debugpod"
+	labelSession          = "debugpod.josledp.github.io/session"
+	labelOwner            = "debugpod.josledp.github.io/owner"
+	labelTargetPod        = "debugpod.josledp.github.io/target-pod"
+	labelTargetNode       = "debugpod.josledp.github.io/target-node"
+	annotationOwner       = "debugpod.josledp.github.io/owner"
+	annotationTarget      = "debugpod.josledp.github.io/target"
+	annotationSecurity    = "debugpod.josledp.github.io/security-profile"
+	annotationsVolumeName = "podinfo"
+)
+
+const (
+	// heartbeatInterval is how often the client renews the heartbeat.
+	heartbeatInterval = 30 * time.Second
+	// heartbeatGrace is how long a debug pod survives without heartbeats. The
+	// downward API takes up to a minute to see a new annotation.
+	heartbeatGrace = 5 * time.Minute
+	// maxSessionLifetime bounds debug pods even if the watchdog fails, and
+	// sessions can not be extended beyond it.
+	maxSessionLifetime = 24 * time.Hour
+)
+
+var invalidLabelChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// labelValue sanitizes s into a valid label value.
+func labelValue(s string) string {
+	s = invalidLabelChars.ReplaceAllString(s, "_")
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return strings.Trim(s, "_.-")
+}
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// targetDescription describes what the session debugs.
+func (dp *DebugPod) targetDescription() string {
+	if dp.targetPod == "" {
+		return "node/" + dp.targetNode
+	}
+	return fmt.Sprintf("pod/%s/%s", dp.targetPod, dp.targetContainer)
+}
+
+// sessionMeta returns the labels and annotations of a debug pod.
+func (dp *DebugPod) sessionMeta() (map[string]string, map[string]string) {
+	owner := currentUser()
+	labels := map[string]string{
+		labelManagedBy:  managedBy,
+		labelSession:    dp.session,
+		labelOwner:      labelValue(owner),
+		labelTargetPod:  labelValue(dp.targetPod),
+		labelTargetNode: labelValue(dp.targetNode),
+	}
+	expires, _ := dp.lifetime.state()
+	annotations := map[string]string{
+		annotationOwner:           owner,
+		annotationTarget:          dp.targetDescription(),
+		annotationSecurity:        dp.securityProfile,
+		agent.HeartbeatAnnotation: time.Now().UTC().Format(time.RFC3339),
+		agent.ExpiresAnnotation:   expires.UTC().Format(time.RFC3339),
+	}
+	return labels, annotations
+}
+
+// heartbeat renews the heartbeat annotation of the debug pod until the
+// context is done.
+func (dp *DebugPod) heartbeat() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-dp.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := dp.sendHeartbeat(); err != nil {
+				log.Printf("unable to send heartbeat: %v", err)
+			}
+		}
+	}
+}
+
+func (dp *DebugPod) sendHeartbeat() error {
+	if dp.mode == modeEphemeral {
+		return dp.sendEphemeralHeartbeat()
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				agent.HeartbeatAnnotation: time.Now().UTC().Format(time.RFC3339),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	pod, err := dp.k8s.CoreV1().Pods(dp.targetNamespace).Patch(dp.podName, types.StrategicMergePatchType, patch)
+	if err != nil {
+		return err
+	}
+	dp.updateExpires(pod)
+	return nil
+}
+
+// staleReason tells why a debug pod is stale, or returns "" if it is alive.
+func staleReason(pod *v1.Pod, olderThan time.Duration) string {
+	if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+		return "finished"
+	}
+	if pod.Annotations[agent.DetachedAnnotation] == "true" {
+		// Detached sessions have no client sending heartbeats.
+		expires, err := time.Parse(time.RFC3339, pod.Annotations[agent.ExpiresAnnotation])
+		if err == nil && time.Now().After(expires) {
+			return "expired"
+		}
+		if err == nil {
+			return ""
+		}
+	}
+	last := pod.CreationTimestamp.Time
+	if heartbeat, err := time.Parse(time.RFC3339, pod.Annotations[agent.HeartbeatAnnotation]); err == nil {
+		last = heartbeat
+	}
+	if age := time.Since(last); age > olderThan {
+		return fmt.Sprintf("no heartbeat for %v", age.Round(time.Second))
+	}
+	return ""
+}
+
+func gcCommand(args []string) {
+	fg := flag.NewFlagSet(commandName+" gc", flag.ExitOnError)
+	cf := addClientFlags(fg)
+	allNamespaces := fg.Bool("all-namespaces", true, "(optional) look for stale sessions in every namespace, not only in -namespace")
+	olderThan := fg.Duration("older-than", heartbeatGrace, "(optional) delete sessions without heartbeats for this long")
+	dryRun := fg.Bool("dry-run", false, "(optional) only print the stale sessions")
+
+	err := fg.Parse(args)
+	if err != nil {
+		log.Fatalf("unable to parse args: %v", err)
+	}
+
+	k8s, err := kubernetes.NewForConfig(cf.config())
+	if err != nil {
+		log.Fatalf("unable to setup client: %v", err)
+	}
+	namespace := cf.namespace()
+	if *allNamespaces {
+		namespace = metav1.NamespaceAll
+	}
+
+	pods, err := k8s.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: labelManagedBy + "=" + managedBy})
+	if err != nil {
+		log.Fatalf("unable to list debug pods: %v", err)
+	}
+	failed := false
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		reason := staleReason(pod, *olderThan)
+		if reason == "" {
+			continue
+		}
+		log.Printf("%s/%s owned by %s (%s)", pod.Namespace, pod.Name, pod.Annotations[annotationOwner], reason)
+		if *dryRun {
+			continue
+		}
+		err := k8s.CoreV1().Pods(pod.Namespace).Delete(pod.Name, &metav1.DeleteOptions{})
+		if err != nil {
+			log.Printf("unable to delete %s/%s: %v", pod.Namespace, pod.Name, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
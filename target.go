@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	pickNewest        = "newest"
+	pickLeastRestarts = "least-restarts"
+	pickNodePrefix    = "node="
+)
+
+// resolveTarget turns a target such as deploy/api, svc/frontend or a plain
+// pod name, or a label selector, into the name of a running pod. finished
+// pods are picked too when finished is set, they can still be copied.
+func (dp *DebugPod) resolveTarget(target, selector, pick string, finished bool) (string, error) {
+	if selector != "" {
+		if target != "" {
+			return "", fmt.Errorf("a target and a selector can not be used at the same time")
+		}
+		return dp.pickPod(selector, pick, finished)
+	}
+
+	parts := strings.SplitN(target, "/", 2)
+	if len(parts) == 1 {
+		return target, nil
+	}
+	kind, name := strings.ToLower(parts[0]), parts[1]
+
+	var sel *metav1.LabelSelector
+	var err error
+	switch kind {
+	case "po", "pod", "pods":
+		return name, nil
+	case "deploy", "deployment", "deployments":
+		deploy, e := dp.k8s.AppsV1().Deployments(dp.targetNamespace).Get(name, metav1.GetOptions{})
+		if err = e; err == nil {
+			sel = deploy.Spec.Selector
+		}
+	case "sts", "statefulset", "statefulsets":
+		sts, e := dp.k8s.AppsV1().StatefulSets(dp.targetNamespace).Get(name, metav1.GetOptions{})
+		if err = e; err == nil {
+			sel = sts.Spec.Selector
+		}
+	case "ds", "daemonset", "daemonsets":
+		ds, e := dp.k8s.AppsV1().DaemonSets(dp.targetNamespace).Get(name, metav1.GetOptions{})
+		if err = e; err == nil {
+			sel = ds.Spec.Selector
+		}
+	case "rs", "replicaset", "replicasets":
+		rs, e := dp.k8s.AppsV1().ReplicaSets(dp.targetNamespace).Get(name, metav1.GetOptions{})
+		if err = e; err == nil {
+			sel = rs.Spec.Selector
+		}
+	case "job", "jobs":
+		job, e := dp.k8s.BatchV1().Jobs(dp.targetNamespace).Get(name, metav1.GetOptions{})
+		if err = e; err == nil {
+			sel = job.Spec.Selector
+		}
+	case "svc", "service", "services":
+		svc, e := dp.k8s.CoreV1().Services(dp.targetNamespace).Get(name, metav1.GetOptions{})
+		if err = e; err == nil {
+			if len(svc.Spec.Selector) == 0 {
+				return "", fmt.Errorf("service %s has no selector", name)
+			}
+			sel = &metav1.LabelSelector{MatchLabels: svc.Spec.Selector}
+		}
+	default:
+		return "", fmt.Errorf("unsupported target kind %s, valid kinds are: pod, deploy, sts, ds, rs, job, svc", kind)
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to get %s: %v", target, err)
+	}
+
+	selectorString, err := metav1.LabelSelectorAsSelector(sel)
+	if err != nil {
+		return "", fmt.Errorf("invalid selector in %s: %v", target, err)
+	}
+	return dp.pickPod(selectorString.String(), pick, finished)
+}
+
+// pickPod chooses one running pod matching selector according to pick, or
+// one that already finished if finished is set.
+func (dp *DebugPod) pickPod(selector, pick string, finished bool) (string, error) {
+	if pick != "" && pick != pickNewest && pick != pickLeastRestarts && !strings.HasPrefix(pick, pickNodePrefix) {
+		return "", fmt.Errorf("unknown pick rule %s, valid rules are: %s, %s, %s<node>", pick, pickNewest, pickLeastRestarts, pickNodePrefix)
+	}
+	if _, err := labels.Parse(selector); err != nil {
+		return "", fmt.Errorf("invalid selector %s: %v", selector, err)
+	}
+	list, err := dp.k8s.CoreV1().Pods(dp.targetNamespace).List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return "", fmt.Errorf("unable to list pods: %v", err)
+	}
+
+	var pods []v1.Pod
+	for _, p := range list.Items {
+		if p.DeletionTimestamp != nil {
+			continue
+		}
+		switch p.Status.Phase {
+		case v1.PodRunning:
+		case v1.PodSucceeded, v1.PodFailed:
+			if !finished {
+				continue
+			}
+		default:
+			continue
+		}
+		if strings.HasPrefix(pick, pickNodePrefix) && p.Spec.NodeName != strings.TrimPrefix(pick, pickNodePrefix) {
+			continue
+		}
+		pods = append(pods, p)
+	}
+	if len(pods) == 0 {
+		state := "running"
+		if finished {
+			state = "running or finished"
+		}
+		return "", fmt.Errorf("no %s pods match %s in namespace %s", state, selector, dp.targetNamespace)
+	}
+
+	if pick == pickLeastRestarts {
+		sort.SliceStable(pods, func(i, j int) bool { return restarts(&pods[i]) < restarts(&pods[j]) })
+	} else {
+		sort.SliceStable(pods, func(i, j int) bool { return pods[j].CreationTimestamp.Before(&pods[i].CreationTimestamp) })
+	}
+
+	log.Printf("picked pod %s on node %s out of %d matching pods", pods[0].Name, pods[0].Spec.NodeName, len(pods))
+	return pods[0].Name, nil
+}
+
+func restarts(pod *v1.Pod) int32 {
+	var n int32
+	for _, s := range pod.Status.ContainerStatuses {
+		n += s.RestartCount
+	}
+	return n
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// Reasons of a StartError.
+const (
+	ReasonImagePull     = "ImagePullBackOff"
+	ReasonUnschedulable = "Unschedulable"
+	ReasonFailedMount   = "FailedMount"
+	ReasonForbidden     = "Forbidden"
+	ReasonCrashed       = "ContainerFailed"
+	ReasonTimeout       = "Timeout"
+)
+
+// StartError is a failure of the debug container to get ready.
+type StartError struct {
+	Reason  string
+	Message string
+}
+
+func (e *StartError) Error() string {
+	if e.Message == "" {
+		return e.Reason
+	}
+	return fmt.Sprintf("%s: %s", e.Reason, e.Message)
+}
+
+// waitingReasons are the container waiting reasons that will not resolve by
+// themselves.
+var waitingReasons = map[string]string{
+	"ErrImagePull":               ReasonImagePull,
+	"ImagePullBackOff":           ReasonImagePull,
+	"InvalidImageName":           ReasonImagePull,
+	"ErrImageNeverPull":          ReasonImagePull,
+	"CreateContainerConfigError": ReasonCrashed,
+	"CreateContainerError":       ReasonCrashed,
+	"CrashLoopBackOff":           ReasonCrashed,
+}
+
+// eventReasons are the warning events that make the debug container fail.
+var eventReasons = map[string]string{
+	"FailedScheduling":   ReasonUnschedulable,
+	"FailedMount":        ReasonFailedMount,
+	"FailedAttachVolume": ReasonFailedMount,
+	"Failed":             ReasonCrashed,
+}
+
+// waitForContainer watches the debug pod and its events until the debug
+// container is ready, failing as soon as it can not get ready.
+func (dp *DebugPod) waitForContainer(timeout time.Duration) error {
+	podWatch, err := dp.watchPod()
+	if err != nil {
+		return err
+	}
+	defer func() { podWatch.Stop() }()
+	eventWatch, err := dp.watchEvents()
+	if err != nil {
+		return err
+	}
+	defer func() { eventWatch.Stop() }()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var waiting string
+	for {
+		select {
+		case <-dp.ctx.Done():
+			return fmt.Errorf("exited because requested")
+		case <-timer.C:
+			return &StartError{Reason: ReasonTimeout, Message: fmt.Sprintf("not ready after %v%s", timeout, waiting)}
+		case ev, ok := <-podWatch.ResultChan():
+			if !ok {
+				if podWatch, err = dp.watchPod(); err != nil {
+					return err
+				}
+				continue
+			}
+			pod, ok := ev.Object.(*v1.Pod)
+			if !ok {
+				continue
+			}
+			ready, reason, err := dp.containerReady(pod)
+			if err != nil || ready {
+				return err
+			}
+			if reason != "" {
+				waiting = " (" + reason + ")"
+			}
+		case ev, ok := <-eventWatch.ResultChan():
+			if !ok {
+				if eventWatch, err = dp.watchEvents(); err != nil {
+					return err
+				}
+				continue
+			}
+			event, ok := ev.Object.(*v1.Event)
+			if !ok || event.Type != v1.EventTypeWarning {
+				continue
+			}
+			if dp.mode == modeEphemeral && !strings.Contains(event.InvolvedObject.FieldPath, dp.container) {
+				continue
+			}
+			if reason, ok := eventReasons[event.Reason]; ok {
+				return &StartError{Reason: reason, Message: event.Message}
+			}
+		}
+	}
+}
+
+func (dp *DebugPod) watchPod() (watch.Interface, error) {
+	w, err := dp.k8s.CoreV1().Pods(dp.targetNamespace).Watch(metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", dp.podName).String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to watch pod %s: %v", dp.podName, err)
+	}
+	return w, nil
+}
+
+func (dp *DebugPod) watchEvents() (watch.Interface, error) {
+	w, err := dp.k8s.CoreV1().Events(dp.targetNamespace).Watch(metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("involvedObject.name", dp.podName).String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to watch events of pod %s: %v", dp.podName, err)
+	}
+	return w, nil
+}
+
+// containerReady checks the debug container in pod. It returns why it is not
+// ready yet, or an error if it never will be.
+func (dp *DebugPod) containerReady(pod *v1.Pod) (bool, string, error) {
+	statuses := pod.Status.ContainerStatuses
+	if dp.mode == modeEphemeral {
+		// The watched pod lacks ephemeral container statuses.
+		raw, err := dp.k8s.CoreV1().RESTClient().Get().Namespace(dp.targetNamespace).Resource("pods").Name(dp.podName).DoRaw()
+		if err != nil {
+			return false, "", fmt.Errorf("unable to retrieve pod status: %v", err)
+		}
+		tp, err := decodeTargetPod(raw)
+		if err != nil {
+			return false, "", err
+		}
+		statuses = tp.ephemeralContainerStatuses
+	} else {
+		for _, c := range pod.Status.Conditions {
+			if c.Type == v1.PodScheduled && c.Status == v1.ConditionFalse && c.Reason == v1.PodReasonUnschedulable {
+				return false, "", &StartError{Reason: ReasonUnschedulable, Message: c.Message}
+			}
+		}
+		if pod.Status.Phase == v1.PodFailed || pod.Status.Phase == v1.PodSucceeded {
+			return false, "", &StartError{Reason: ReasonCrashed, Message: fmt.Sprintf("pod %s %s", strings.ToLower(string(pod.Status.Phase)), pod.Status.Message)}
+		}
+	}
+
+	for _, s := range statuses {
+		if s.Name != dp.container {
+			continue
+		}
+		switch {
+		case s.State.Terminated != nil:
+			return false, "", &StartError{Reason: ReasonCrashed, Message: fmt.Sprintf("container terminated: %s %s", s.State.Terminated.Reason, s.State.Terminated.Message)}
+		case s.State.Waiting != nil:
+			if reason, ok := waitingReasons[s.State.Waiting.Reason]; ok {
+				return false, "", &StartError{Reason: reason, Message: s.State.Waiting.Message}
+			}
+			return false, s.State.Waiting.Reason, nil
+		case dp.mode == modeEphemeral:
+			return s.State.Running != nil, "", nil
+		default:
+			return s.Ready, "", nil
+		}
+	}
+	return false, string(pod.Status.Phase), nil
+}